@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	lib "github.com/teepark/ldbrest/libldbrest"
+)
+
+// access log flags
+var (
+	accessLogPath   string
+	accessLogFormat string
+	accessLogSample float64
+	accessLogSlow   time.Duration
+)
+
+// reopener is a file that can be closed and reopened at the same path,
+// so logrotate can move it out of the way and send a SIGHUP
+type reopener struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func (ro *reopener) Write(b []byte) (int, error) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	return ro.f.Write(b)
+}
+
+func (ro *reopener) reopen() error {
+	f, err := os.OpenFile(ro.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	if ro.f != nil {
+		ro.f.Close()
+	}
+	ro.f = f
+	return nil
+}
+
+// setupAccessLog configures access logging from the flags
+func setupAccessLog() {
+	if accessLogPath == "" {
+		return
+	}
+
+	var out io.Writer
+	if accessLogPath == "-" {
+		out = os.Stdout
+	} else {
+		ro := &reopener{path: accessLogPath}
+		if err := ro.reopen(); err != nil {
+			log.Fatalf("opening access log: %s", err)
+		}
+		go reopenOnHUP(ro)
+		out = ro
+	}
+
+	if err := lib.SetAccessLog(out, accessLogFormat, accessLogSample, accessLogSlow); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func reopenOnHUP(ro *reopener) {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	for range hups {
+		if err := ro.reopen(); err != nil {
+			log.Printf("reopening access log (still writing to the old one): %s", err)
+		}
+	}
+}
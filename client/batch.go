@@ -0,0 +1,59 @@
+package client
+
+import "context"
+
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Batch collects updates to apply atomically with Client.Batch.
+//
+//	b := &client.Batch{}
+//	b.Put("a", []byte("A")).Delete("b")
+//	err := c.Batch(ctx, b)
+type Batch struct {
+	ops []batchOp
+}
+
+// Put adds setting key to value to the batch.
+func (b *Batch) Put(key string, value []byte) *Batch {
+	b.ops = append(b.ops, batchOp{"put", key, string(value)})
+	return b
+}
+
+// Delete adds removing key to the batch.
+func (b *Batch) Delete(key string) *Batch {
+	b.ops = append(b.ops, batchOp{"delete", key, ""})
+	return b
+}
+
+// Patch adds applying a merge patch or JSON Patch to key's value (as of the
+// batch's earlier updates) to the batch.
+func (b *Batch) Patch(key string, patch []byte) *Batch {
+	b.ops = append(b.ops, batchOp{"patch", key, string(patch)})
+	return b
+}
+
+// Len is the number of updates in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Batch applies all of b's updates atomically. If one of them is invalid
+// none are applied, and the *Error's OpIndex says which one it was.
+func (c *Client) Batch(ctx context.Context, b *Batch) error {
+	ops := b.ops
+	if ops == nil {
+		ops = []batchOp{}
+	}
+	return c.doJSON(ctx, "POST", "/batch", nil, &struct {
+		Ops []batchOp `json:"ops"`
+	}{ops}, nil)
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// BucketInfo describes a bucket.
+type BucketInfo struct {
+	Name    string    `json:"name"`
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+
+	// only set by BucketStats
+	Keys int64 `json:"keys"`
+	Size int64 `json:"size"`
+}
+
+func bucketPath(name string) string {
+	return "/b/" + url.PathEscape(name)
+}
+
+// Bucket returns a Client for the keys in a bucket. Its Get, Stat, Put, Patch,
+// Upsert, Delete and Iterate work within the bucket; its other methods don't
+// apply to buckets. It shares c's settings as they are now.
+func (c *Client) Bucket(name string) *Client {
+	bc := *c
+	bc.base += bucketPath(name)
+	return &bc
+}
+
+// CreateBucket creates a bucket, or does nothing if it already exists.
+func (c *Client) CreateBucket(ctx context.Context, name string) (*BucketInfo, error) {
+	info := &BucketInfo{}
+	if err := c.doJSON(ctx, "PUT", bucketPath(name), nil, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DropBucket deletes a bucket and all its keys.
+func (c *Client) DropBucket(ctx context.Context, name string) error {
+	_, err := c.doBytes(ctx, "DELETE", bucketPath(name), nil, nil)
+	return err
+}
+
+// Buckets lists the buckets.
+func (c *Client) Buckets(ctx context.Context) ([]*BucketInfo, error) {
+	var infos []*BucketInfo
+	if err := c.doJSON(ctx, "GET", "/buckets", nil, nil, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// BucketStats counts a bucket's keys and their size.
+func (c *Client) BucketStats(ctx context.Context, name string) (*BucketInfo, error) {
+	info := &BucketInfo{}
+	if err := c.doJSON(ctx, "GET", bucketPath(name)+"/stats", nil, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
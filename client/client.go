@@ -0,0 +1,374 @@
+/*
+Package client is a Go client for an ldbrest server.
+
+	c := client.New("127.0.0.1:7000") // or client.New("/path/to/socket")
+	err := c.Put(ctx, "foo", []byte("bar"))
+	value, err := c.Get(ctx, "foo")
+
+Requests that get a 503 (as every request does while the server is still
+opening its database) are retried, honoring the server's Retry-After, up to
+Client.Retries times.
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key (or property) doesn't exist.
+var ErrNotFound = errors.New("ldbrest: not found")
+
+// Error is an error response from the server.
+type Error struct {
+	// the HTTP status code
+	Status int
+
+	// the machine-readable error code, like "bad_json" or "db_error"
+	Code string
+
+	Message string
+
+	// for errors in a Batch, the index of the offending op (or -1)
+	OpIndex int
+}
+
+func (e *Error) Error() string {
+	if e.OpIndex >= 0 {
+		return fmt.Sprintf("ldbrest: %d %s: %s (op %d)", e.Status, e.Code, e.Message, e.OpIndex)
+	}
+	return fmt.Sprintf("ldbrest: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Client talks to one ldbrest server. It is safe for concurrent use.
+type Client struct {
+	// Token, if set, is sent as a bearer token with every request.
+	Token string
+
+	// Retries is how many times to retry a request that got a 503.
+	Retries int
+
+	// RetryWait is how long to wait before a retry when the server
+	// doesn't send a Retry-After.
+	RetryWait time.Duration
+
+	base string
+	http *http.Client
+}
+
+// New creates a Client for the server at addr, which like ldbrest's own
+// -serveaddr flag is a "[host]:port" for TCP or else a unix socket path.
+func New(addr string) *Client {
+	return newClient(addr, nil)
+}
+
+// NewTLS creates a Client for a TLS server at "[host]:port". cfg can carry a
+// client certificate for servers that require one.
+func NewTLS(addr string, cfg *tls.Config) *Client {
+	return newClient(addr, cfg)
+}
+
+func newClient(addr string, cfg *tls.Config) *Client {
+	transport := &http.Transport{TLSClientConfig: cfg}
+	base := "http://" + addr
+	if cfg != nil {
+		base = "https://" + addr
+	}
+
+	if !strings.Contains(addr, ":") {
+		base = "http://unix"
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", addr)
+		}
+	}
+
+	return &Client{
+		Retries:   10,
+		RetryWait: 500 * time.Millisecond,
+		base:      base,
+		http:      &http.Client{Transport: transport},
+	}
+}
+
+// do sends a request, retrying 503s. a non-2xx response is turned into an
+// error, otherwise the caller must close the response body.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		var rbody io.Reader
+		if body != nil {
+			rbody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, u, rbody)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		err = responseError(resp)
+		if resp.StatusCode != http.StatusServiceUnavailable || attempt >= c.Retries {
+			return nil, err
+		}
+
+		wait := c.RetryWait
+		if secs, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+			wait = time.Duration(secs) * time.Second
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// responseError reads an error response into an *Error (or ErrNotFound)
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	body := &struct {
+		Error *struct {
+			Code    string
+			Message string
+			OpIndex *int `json:"op_index"`
+		}
+	}{}
+	b, _ := ioutil.ReadAll(resp.Body)
+
+	e := &Error{Status: resp.StatusCode, Code: "unknown", Message: strings.TrimSpace(string(b)), OpIndex: -1}
+	if json.Unmarshal(b, body) == nil && body.Error != nil {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+		if body.Error.OpIndex != nil {
+			e.OpIndex = *body.Error.OpIndex
+		}
+	}
+
+	// (HEAD responses have no body to say so)
+	if e.Status == http.StatusNotFound && (e.Code == "not_found" || resp.Request.Method == "HEAD") {
+		return ErrNotFound
+	}
+	return e
+}
+
+// doJSON sends req (if not nil) as a JSON body and decodes a JSON
+// response into resp (if not nil)
+func (c *Client) doJSON(ctx context.Context, method, path string, query url.Values, req, resp interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+
+	r, err := c.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// doBytes sends a request and reads the whole response body
+func (c *Client) doBytes(ctx context.Context, method, path string, query url.Values, body []byte) ([]byte, error) {
+	r, err := c.do(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	return ioutil.ReadAll(r.Body)
+}
+
+func keyPath(key string) string {
+	return "/key/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// Get retrieves the value of a key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.doBytes(ctx, "GET", keyPath(key), nil, nil)
+}
+
+// Info describes a value without its contents.
+type Info struct {
+	Size        int64
+	ContentType string
+	ETag        string
+	Modified    time.Time // zero if the server didn't record it
+}
+
+// Stat retrieves a key's Info (with a HEAD request), or ErrNotFound.
+func (c *Client) Stat(ctx context.Context, key string) (*Info, error) {
+	resp, err := c.do(ctx, "HEAD", keyPath(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	info := &Info{
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		info.Modified, _ = http.ParseTime(lm)
+	}
+	return info, nil
+}
+
+// Put sets the value of a key.
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := c.doBytes(ctx, "PUT", keyPath(key), nil, value)
+	return err
+}
+
+// Patch atomically updates a key's JSON value with patch, an RFC 7386 merge
+// patch object or an RFC 6902 JSON Patch array, and returns the new value. A
+// key that doesn't exist is ErrNotFound.
+func (c *Client) Patch(ctx context.Context, key string, patch []byte) ([]byte, error) {
+	return c.doBytes(ctx, "PATCH", keyPath(key), nil, patch)
+}
+
+// Upsert is like Patch, except that a key that doesn't exist patches like
+// null and is created.
+func (c *Client) Upsert(ctx context.Context, key string, patch []byte) ([]byte, error) {
+	return c.doBytes(ctx, "PATCH", keyPath(key), url.Values{"upsert": {"yes"}}, patch)
+}
+
+// Delete removes a key. Deleting a key that doesn't exist isn't an error.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.doBytes(ctx, "DELETE", keyPath(key), nil, nil)
+	return err
+}
+
+// GetMany retrieves several keys at once. Keys that don't exist come back
+// with empty values.
+func (c *Client) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	resp := make(map[string]string)
+	err := c.doJSON(ctx, "POST", "/keys", nil, &struct {
+		Keys []string `json:"keys"`
+	}{keys}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(resp))
+	for k, v := range resp {
+		values[k] = []byte(v)
+	}
+	return values, nil
+}
+
+// Property retrieves a leveldb property, or ErrNotFound.
+func (c *Client) Property(ctx context.Context, name string) (string, error) {
+	b, err := c.doBytes(ctx, "GET", "/property/"+url.PathEscape(name), nil, nil)
+	return string(b), err
+}
+
+// SnapshotSpec describes a POST /snapshot. Only Destination is required.
+type SnapshotSpec struct {
+	Destination string `json:"destination"`
+	Start       string `json:"start,omitempty"`
+	End         string `json:"end,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+	StripPrefix string `json:"strip_prefix,omitempty"`
+}
+
+// Snapshot copies the database (or the part spec calls for) to a new
+// database on the server's filesystem.
+func (c *Client) Snapshot(ctx context.Context, spec SnapshotSpec) error {
+	return c.doJSON(ctx, "POST", "/snapshot", nil, &spec, nil)
+}
+
+// Restore swaps the served database for the snapshot at source.
+func (c *Client) Restore(ctx context.Context, source string) error {
+	return c.doJSON(ctx, "POST", "/restore", nil, &struct {
+		Source string `json:"source"`
+	}{source}, nil)
+}
+
+// UndoRestore swaps back the database the last Restore replaced.
+func (c *Client) UndoRestore(ctx context.Context) error {
+	return c.doJSON(ctx, "POST", "/restore", nil, &struct {
+		Undo bool `json:"undo"`
+	}{true}, nil)
+}
+
+// Limits are the server's request size limits, zero meaning no limit.
+type Limits struct {
+	MaxBodySize  int64 `json:"max_body_size"`
+	MaxValueSize int   `json:"max_value_size"`
+	MaxKeyLength int   `json:"max_key_length"`
+	MaxKeys      int   `json:"max_keys"`
+	MaxBatchOps  int   `json:"max_batch_ops"`
+}
+
+// Limits retrieves the server's request size limits.
+func (c *Client) Limits(ctx context.Context) (*Limits, error) {
+	l := &Limits{}
+	if err := c.doJSON(ctx, "GET", "/limits", nil, nil, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Metrics retrieves the server's metrics in prometheus' text format.
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	b, err := c.doBytes(ctx, "GET", "/metrics", nil, nil)
+	return string(b), err
+}
+
+// Healthy checks that the server is up. With deep it also checks
+// that its database can be written to and read from.
+func (c *Client) Healthy(ctx context.Context, deep bool) error {
+	q := url.Values{}
+	if deep {
+		q.Set("deep", "yes")
+	}
+	_, err := c.doBytes(ctx, "GET", "/healthz", q, nil)
+	return err
+}
+
+// Ready checks that the server is ready to serve requests. Unlike other
+// methods it doesn't retry if it isn't.
+func (c *Client) Ready(ctx context.Context) error {
+	retries := *c
+	retries.Retries = 0
+	_, err := retries.doBytes(ctx, "GET", "/readyz", nil, nil)
+	return err
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	lib "github.com/teepark/ldbrest/libldbrest"
+)
+
+func setup(tb testing.TB) (*Client, func()) {
+	dirpath, err := ioutil.TempDir("", "ldbrest_client_test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	lib.OpenDB(dirpath + "/db")
+
+	srv := httptest.NewServer(lib.InitRouter(""))
+	c := New(srv.Listener.Addr().String())
+
+	return c, func() {
+		srv.Close()
+		lib.CleanupDB()
+		os.RemoveAll(dirpath)
+	}
+}
+
+func TestGetPutDelete(t *testing.T) {
+	c, done := setup(t)
+	defer done()
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "a/b?c", []byte("A")); err != nil {
+		t.Fatal(err)
+	}
+	val, err := c.Get(ctx, "a/b?c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "A" {
+		t.Fatalf("wrong value: %s", val)
+	}
+
+	if err := c.Delete(ctx, "a/b?c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "a/b?c"); err != ErrNotFound {
+		t.Fatalf("wrong error for a deleted key: %v", err)
+	}
+}
+
+func TestPatchUpsert(t *testing.T) {
+	c, done := setup(t)
+	defer done()
+	ctx := context.Background()
+
+	if _, err := c.Patch(ctx, "doc", []byte(`{"a": 1}`)); err != ErrNotFound {
+		t.Fatalf("wrong error patching a missing key: %v", err)
+	}
+	val, err := c.Upsert(ctx, "doc", []byte(`{"a": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err = c.Patch(ctx, "doc", []byte(`{"b": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != `{"a":1,"b":2}` {
+		t.Fatalf("wrong patched value: %s", val)
+	}
+}
+
+func TestBatchAndIterate(t *testing.T) {
+	c, done := setup(t)
+	defer done()
+	ctx := context.Background()
+
+	b := &Batch{}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		b.Put(key, []byte(key+key))
+	}
+	if err := c.Batch(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// page through 2 at a time
+	it := c.Iterate(ctx, IterOptions{Start: "b", End: "e", PageSize: 2})
+	var keys []string
+	for it.Next() {
+		if string(it.Value()) != it.Key()+it.Key() {
+			t.Fatalf("wrong value for %s: %s", it.Key(), it.Value())
+		}
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != "b" || keys[2] != "d" {
+		t.Fatalf("wrong iterated keys: %v", keys)
+	}
+
+	it = c.Iterate(ctx, IterOptions{Reverse: true, KeysOnly: true, PageSize: 2})
+	keys = nil
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if len(keys) != 5 || keys[0] != "e" || keys[4] != "a" {
+		t.Fatalf("wrong reverse iterated keys: %v", keys)
+	}
+
+	b = &Batch{}
+	b.Put("f", nil)
+	b.ops = append(b.ops, batchOp{Op: "frob", Key: "g"})
+	err := c.Batch(ctx, b)
+	if e, ok := err.(*Error); !ok || e.Code != "bad_batch_op" || e.OpIndex != 1 {
+		t.Fatalf("wrong error for a bad batch: %v", err)
+	}
+}
+
+func TestTxnBucket(t *testing.T) {
+	c, done := setup(t)
+	defer done()
+	ctx := context.Background()
+
+	if _, err := c.CreateBucket(ctx, "users"); err != nil {
+		t.Fatal(err)
+	}
+	txn, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Bucket("users").Put(ctx, "a", []byte("in users")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Put(ctx, "a", []byte("top")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := c.Bucket("users").Get(ctx, "a"); err != nil || string(val) != "in users" {
+		t.Fatalf("wrong bucket value: %q %v", val, err)
+	}
+	if val, err := c.Get(ctx, "a"); err != nil || string(val) != "top" {
+		t.Fatalf("wrong top-level value: %q %v", val, err)
+	}
+}
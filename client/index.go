@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+)
+
+// Index describes a secondary index and its latest background build.
+type Index struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+
+	Rebuild *struct {
+		State   string `json:"state"`
+		Scanned int    `json:"scanned"`
+		Error   string `json:"error"`
+	} `json:"rebuild"`
+}
+
+func indexPath(name string) string {
+	return "/index/" + url.PathEscape(name)
+}
+
+// CreateIndex declares (or redeclares) an index over the JSON values of keys
+// under prefix, by the scalar at the dotted path. Entries for existing keys
+// are built in the background.
+func (c *Client) CreateIndex(ctx context.Context, name, prefix, path string) (*Index, error) {
+	idx := &Index{}
+	err := c.doJSON(ctx, "PUT", indexPath(name), nil, &Index{Prefix: prefix, Path: path}, idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// RebuildIndex starts an index's background build over again.
+func (c *Client) RebuildIndex(ctx context.Context, name string) (*Index, error) {
+	idx := &Index{}
+	if err := c.doJSON(ctx, "POST", indexPath(name)+"/rebuild", nil, nil, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// DropIndex removes an index and its entries.
+func (c *Client) DropIndex(ctx context.Context, name string) error {
+	_, err := c.doBytes(ctx, "DELETE", indexPath(name), nil, nil)
+	return err
+}
+
+// Indexes lists the declared indexes.
+func (c *Client) Indexes(ctx context.Context) ([]*Index, error) {
+	var idxs []*Index
+	if err := c.doJSON(ctx, "GET", "/indexes", nil, nil, &idxs); err != nil {
+		return nil, err
+	}
+	return idxs, nil
+}
+
+// IndexQuery selects entries from an index. Values are JSON scalars:
+// strings, float64s, bools or nil.
+type IndexQuery struct {
+	// Value finds the keys with exactly this value, if HasValue.
+	Value    interface{}
+	HasValue bool
+
+	// Start and End bound a range of values instead (nil is unbounded),
+	// including Start but not End by default.
+	Start, End   interface{}
+	ExcludeStart bool
+	IncludeEnd   bool
+
+	// Max is how many keys to return (default and maximum 1000).
+	Max int
+
+	// KeysOnly skips fetching values.
+	KeysOnly bool
+
+	// After continues from the Next of a previous IndexResult.
+	After string
+}
+
+// IndexHit is a key found by an index lookup.
+type IndexHit struct {
+	Key        string      `json:"key"`
+	IndexValue interface{} `json:"index_value"`
+	Value      *string     `json:"value"`
+}
+
+// IndexResult is a page of an index lookup.
+type IndexResult struct {
+	More bool        `json:"more"`
+	Next string      `json:"next"`
+	Data []*IndexHit `json:"data"`
+}
+
+// LookupIndex finds keys by their values in an index.
+func (c *Client) LookupIndex(ctx context.Context, name string, q IndexQuery) (*IndexResult, error) {
+	query := url.Values{}
+	set := func(param string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err == nil {
+			query.Set(param, string(b))
+		}
+		return err
+	}
+
+	if q.HasValue {
+		if err := set("value", q.Value); err != nil {
+			return nil, err
+		}
+	} else {
+		if q.Start != nil {
+			if err := set("start", q.Start); err != nil {
+				return nil, err
+			}
+		}
+		if q.End != nil {
+			if err := set("end", q.End); err != nil {
+				return nil, err
+			}
+		}
+		query.Set("include_start", yesno(!q.ExcludeStart))
+		query.Set("include_end", yesno(q.IncludeEnd))
+	}
+	if q.Max > 0 {
+		query.Set("max", strconv.Itoa(q.Max))
+	}
+	query.Set("include_values", yesno(!q.KeysOnly))
+	if q.After != "" {
+		query.Set("after", q.After)
+	}
+
+	res := &IndexResult{}
+	if err := c.doJSON(ctx, "GET", indexPath(name), query, nil, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// IterOptions control an Iterator. The zero value iterates forward over
+// every key.
+type IterOptions struct {
+	// Start is the key to start from (default the first, or last if Reverse).
+	Start string
+
+	// ExcludeStart leaves out the key exactly matching Start.
+	ExcludeStart bool
+
+	// End is the key to stop at (default the last, or first if Reverse).
+	End string
+
+	// IncludeEnd includes the key exactly matching End.
+	IncludeEnd bool
+
+	// Reverse iterates backwards through the sorted keys.
+	Reverse bool
+
+	// KeysOnly skips fetching values.
+	KeysOnly bool
+
+	// PageSize is how many keys to fetch per request (default and
+	// maximum 1000).
+	PageSize int
+}
+
+// Iterator pages through GET /iterate results.
+//
+//	it := c.Iterate(ctx, client.IterOptions{Start: "a", End: "b"})
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	c    *Client
+	ctx  context.Context
+	opts IterOptions
+
+	page []pair
+	i    int
+	last string // where the next page picks up
+	done bool
+	err  error
+}
+
+type pair struct {
+	key, value string
+}
+
+// Iterate starts an iteration. No request is made until the first Next.
+func (c *Client) Iterate(ctx context.Context, opts IterOptions) *Iterator {
+	if opts.PageSize <= 0 || opts.PageSize > 1000 {
+		opts.PageSize = 1000
+	}
+	return &Iterator{c: c, ctx: ctx, opts: opts, i: -1}
+}
+
+// Next advances to the next key, fetching another page if needed. It
+// returns false when the iteration is over or fails (see Err).
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.i++
+	if it.i < len(it.page) {
+		return true
+	}
+	if it.done {
+		return false
+	}
+
+	if err := it.fetch(); err != nil {
+		it.err = err
+		return false
+	}
+	return it.i < len(it.page)
+}
+
+// Key is the current key.
+func (it *Iterator) Key() string {
+	return it.page[it.i].key
+}
+
+// Value is the current value (empty with KeysOnly).
+func (it *Iterator) Value() []byte {
+	return []byte(it.page[it.i].value)
+}
+
+// Err is the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func yesno(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func (it *Iterator) fetch() error {
+	q := url.Values{}
+	q.Set("max", strconv.Itoa(it.opts.PageSize))
+	q.Set("forward", yesno(!it.opts.Reverse))
+	q.Set("include_values", yesno(!it.opts.KeysOnly))
+	if it.opts.End != "" {
+		q.Set("end", it.opts.End)
+		q.Set("include_end", yesno(it.opts.IncludeEnd))
+	}
+
+	// later pages pick up after the last key of the one before
+	if it.last != "" {
+		q.Set("start", it.last)
+		q.Set("include_start", "no")
+	} else if it.opts.Start != "" {
+		q.Set("start", it.opts.Start)
+		q.Set("include_start", yesno(!it.opts.ExcludeStart))
+	}
+
+	var page []pair
+	var more bool
+	var last string
+	if it.opts.KeysOnly {
+		resp := &struct {
+			More bool
+			Data []string
+			Last string
+		}{}
+		if err := it.c.doJSON(it.ctx, "GET", "/iterate", q, nil, resp); err != nil {
+			return err
+		}
+		for _, key := range resp.Data {
+			page = append(page, pair{key: key})
+		}
+		more, last = resp.More, resp.Last
+	} else {
+		resp := &struct {
+			More bool
+			Data []struct{ Key, Value string }
+			Last string
+		}{}
+		if err := it.c.doJSON(it.ctx, "GET", "/iterate", q, nil, resp); err != nil {
+			return err
+		}
+		for _, kv := range resp.Data {
+			page = append(page, pair{kv.Key, kv.Value})
+		}
+		more, last = resp.More, resp.Last
+	}
+
+	// without an end, a full page is the only sign there may be more
+	it.done = len(page) < it.opts.PageSize || (it.opts.End != "" && !more)
+	it.page, it.i = page, 0
+
+	// the server reports where to resume when there's more, older ones
+	// don't so it's the last key of the page
+	switch {
+	case last != "":
+		it.last = last
+	case len(page) > 0:
+		it.last = page[len(page)-1].key
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+// ErrConflict is returned by Txn.Commit when a key the transaction read was
+// written after it began, so none of its writes were applied.
+var ErrConflict = errors.New("ldbrest: transaction conflict")
+
+// Txn is an optimistic transaction. Its reads see the database as it was
+// when it began (plus its own writes), and its writes are applied atomically
+// by Commit, unless something it read has changed by then.
+//
+//	txn, err := c.Begin(ctx)
+//	a, err := txn.Get(ctx, "a")
+//	err = txn.Put(ctx, "b", a)
+//	err = txn.Commit(ctx) // ErrConflict if "a" changed
+type Txn struct {
+	c  *Client
+	ID string
+
+	// the bucket its keys are in, if any
+	bucket string
+}
+
+// Begin opens a transaction. It expires if it goes unused for the server's
+// -txn-timeout.
+func (c *Client) Begin(ctx context.Context) (*Txn, error) {
+	txn := &Txn{c: c}
+	if err := c.doJSON(ctx, "POST", "/txn", nil, nil, txn); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func (t *Txn) path() string {
+	return "/txn/" + url.PathEscape(t.ID)
+}
+
+func (t *Txn) keyPath(key string) string {
+	if t.bucket != "" {
+		return t.path() + bucketPath(t.bucket) + keyPath(key)
+	}
+	return t.path() + keyPath(key)
+}
+
+// Bucket returns the transaction with its Get, Put and Delete working on the
+// keys in a bucket. Commit and Abort still end the whole transaction.
+func (t *Txn) Bucket(name string) *Txn {
+	bt := *t
+	bt.bucket = name
+	return &bt
+}
+
+// Get retrieves the value of a key as the transaction sees it, or ErrNotFound.
+func (t *Txn) Get(ctx context.Context, key string) ([]byte, error) {
+	return t.c.doBytes(ctx, "GET", t.keyPath(key), nil, nil)
+}
+
+// Put sets a key's value when the transaction commits.
+func (t *Txn) Put(ctx context.Context, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := t.c.doBytes(ctx, "PUT", t.keyPath(key), nil, value)
+	return err
+}
+
+// Delete removes a key when the transaction commits.
+func (t *Txn) Delete(ctx context.Context, key string) error {
+	_, err := t.c.doBytes(ctx, "DELETE", t.keyPath(key), nil, nil)
+	return err
+}
+
+// Commit applies the transaction's writes, or returns ErrConflict. Either way
+// the transaction is over.
+func (t *Txn) Commit(ctx context.Context) error {
+	_, err := t.c.doBytes(ctx, "POST", t.path()+"/commit", nil, nil)
+	if e, ok := err.(*Error); ok && e.Code == "txn_conflict" {
+		return ErrConflict
+	}
+	return err
+}
+
+// Abort abandons the transaction.
+func (t *Txn) Abort(ctx context.Context) error {
+	_, err := t.c.doBytes(ctx, "DELETE", t.path(), nil, nil)
+	return err
+}
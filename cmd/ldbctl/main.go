@@ -0,0 +1,427 @@
+/*
+ldbctl is a command-line client for an ldbrest server.
+
+	ldbctl [-s addr] [-token token] [-o raw|json|table] <command> [args]
+
+The commands are:
+
+	get <key>                 print a key's value
+	put <key> [file]          set a key's value from a file (or stdin)
+	del <key>                 delete a key
+	scan [range flags]        print keys and values in a range
+	count [range flags]       count the keys in a range
+	batch [file]              atomically apply NDJSON ops from a file (or stdin), each
+	                          {"op": "put", "key": ..., "value": ...} or {"op": "delete", "key": ...}
+	property <name>           print a leveldb property
+	snapshot [flags] <dest>   copy the db (or a range of it) to dest on the server
+
+The range flags of scan and count are -prefix, -start, -end, -reverse, and
+for scan -keys to leave out values and -max to stop after that many.
+
+-s is a "[host]:port" or a unix socket path like ldbrest's own -serveaddr
+(default "127.0.0.1:7000"). With -tls it connects over TLS, optionally
+verifying the server against -tls-ca and presenting -tls-cert and -tls-key.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/teepark/ldbrest/client"
+)
+
+var (
+	serveAddr string
+	token     string
+	output    string
+
+	// where commands print their results
+	stdout io.Writer = os.Stdout
+
+	useTLS                 bool
+	tlsCA, tlsCert, tlsKey string
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("ldbctl: ")
+
+	flag.StringVar(&serveAddr, "s", "127.0.0.1:7000", "[host]:port or /path/to/socket of the ldbrest server")
+	flag.StringVar(&token, "token", os.Getenv("LDBREST_TOKEN"), "API token (default $LDBREST_TOKEN)")
+	flag.StringVar(&output, "o", "raw", "output format: raw, json or table")
+	flag.BoolVar(&useTLS, "tls", false, "connect over TLS")
+	flag.StringVar(&tlsCA, "tls-ca", "", "/path/to/ca.pem to verify the server with")
+	flag.StringVar(&tlsCert, "tls-cert", "", "/path/to/cert.pem of a client certificate")
+	flag.StringVar(&tlsKey, "tls-key", "", "/path/to/key.pem for -tls-cert")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ldbctl [flags] get|put|del|scan|count|batch|property|snapshot [args]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if output != "raw" && output != "json" && output != "table" {
+		log.Fatalf("unknown output format %q", output)
+	}
+
+	commands := map[string]func(*client.Client, []string) error{
+		"get":      get,
+		"put":      put,
+		"del":      del,
+		"scan":     scan,
+		"count":    count,
+		"batch":    batch,
+		"property": property,
+		"snapshot": snapshot,
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
+	c, err := newClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.Token = token
+
+	if err := cmd(c, flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newClient() (*client.Client, error) {
+	if !useTLS {
+		return client.New(serveAddr), nil
+	}
+
+	cfg := &tls.Config{}
+	if tlsCA != "" {
+		pem, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + tlsCA)
+		}
+	}
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return client.NewTLS(serveAddr, cfg), nil
+}
+
+// usage fails a command that was given the wrong arguments
+func usage(msg string) error {
+	fmt.Fprintln(os.Stderr, "usage: ldbctl [flags] "+msg)
+	os.Exit(2)
+	return nil
+}
+
+// readInput reads the named file, or stdin if there's no name or it's "-"
+func readInput(args []string) (io.ReadCloser, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(args[0])
+}
+
+// kvWriter prints key/value pairs in the chosen output format
+type kvWriter struct {
+	out *bufio.Writer
+	tw  *tabwriter.Writer
+}
+
+func newKVWriter() *kvWriter {
+	kw := &kvWriter{out: bufio.NewWriter(stdout)}
+	if output == "table" {
+		kw.tw = tabwriter.NewWriter(kw.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(kw.tw, "KEY\tVALUE")
+	}
+	return kw
+}
+
+// write prints a pair, or just a key if value is nil
+func (kw *kvWriter) write(key string, value []byte) {
+	switch output {
+	case "json":
+		obj := map[string]string{"key": key}
+		if value != nil {
+			obj["value"] = string(value)
+		}
+		b, _ := json.Marshal(obj)
+		fmt.Fprintf(kw.out, "%s\n", b)
+	case "table":
+		fmt.Fprintf(kw.tw, "%s\t%s\n", strconv.Quote(key), strconv.Quote(string(value)))
+	default:
+		if value == nil {
+			fmt.Fprintln(kw.out, key)
+		} else {
+			fmt.Fprintf(kw.out, "%s\t%s\n", key, value)
+		}
+	}
+}
+
+func (kw *kvWriter) flush() error {
+	if kw.tw != nil {
+		kw.tw.Flush()
+	}
+	return kw.out.Flush()
+}
+
+func get(c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return usage("get <key>")
+	}
+
+	value, err := c.Get(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	if output == "raw" {
+		_, err = stdout.Write(value)
+		return err
+	}
+	kw := newKVWriter()
+	kw.write(args[0], value)
+	return kw.flush()
+}
+
+func put(c *client.Client, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return usage("put <key> [file]")
+	}
+
+	in, err := readInput(args[1:])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	value, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return c.Put(context.Background(), args[0], value)
+}
+
+func del(c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return usage("del <key>")
+	}
+	return c.Delete(context.Background(), args[0])
+}
+
+// rangeFlags are the flags scan and count share
+type rangeFlags struct {
+	prefix, start, end string
+	reverse            bool
+}
+
+func (rf *rangeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&rf.prefix, "prefix", "", "only keys starting with this")
+	fs.StringVar(&rf.start, "start", "", "first key (inclusive)")
+	fs.StringVar(&rf.end, "end", "", "last key (exclusive)")
+	fs.BoolVar(&rf.reverse, "reverse", false, "iterate backwards (then -start is the highest key)")
+}
+
+// prefixEnd is the first key after all those starting with prefix,
+// or "" if there isn't one
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// options turns the flags into iterator options. ok is false
+// if -prefix rules out the whole range.
+func (rf *rangeFlags) options() (opts client.IterOptions, ok bool) {
+	opts = client.IterOptions{Start: rf.start, End: rf.end, Reverse: rf.reverse}
+	if rf.prefix == "" {
+		return opts, true
+	}
+
+	// narrow the range to the keys starting with prefix. forwards it's
+	// [start, end), and backwards -start is still included and -end still
+	// isn't, but they're the high and low ends.
+	low, high := rf.start, rf.end
+	lowIncluded, highIncluded := true, false
+	if rf.reverse {
+		low, high = rf.end, rf.start
+		lowIncluded, highIncluded = false, true
+	}
+	if low < rf.prefix {
+		low, lowIncluded = rf.prefix, true
+	}
+	if pe := prefixEnd(rf.prefix); pe != "" && (high == "" || high >= pe) {
+		high, highIncluded = pe, false
+	}
+	if high != "" && (low > high || low == high && !(lowIncluded && highIncluded)) {
+		return opts, false
+	}
+
+	if rf.reverse {
+		opts.Start, opts.ExcludeStart = high, high != "" && !highIncluded
+		opts.End, opts.IncludeEnd = low, lowIncluded
+	} else {
+		opts.Start, opts.End = low, high
+	}
+	return opts, true
+}
+
+func scan(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	rf := &rangeFlags{}
+	rf.register(fs)
+	keysOnly := fs.Bool("keys", false, "print only keys")
+	max := fs.Int("max", 0, "stop after this many keys (0 for no limit)")
+	fs.Parse(args)
+
+	kw := newKVWriter()
+	opts, ok := rf.options()
+	if !ok {
+		return kw.flush()
+	}
+	opts.KeysOnly = *keysOnly
+
+	it := c.Iterate(context.Background(), opts)
+	for n := 0; (*max == 0 || n < *max) && it.Next(); n++ {
+		if *keysOnly {
+			kw.write(it.Key(), nil)
+		} else {
+			kw.write(it.Key(), it.Value())
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return kw.flush()
+}
+
+func count(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("count", flag.ExitOnError)
+	rf := &rangeFlags{}
+	rf.register(fs)
+	fs.Parse(args)
+
+	var n int
+	if opts, ok := rf.options(); ok {
+		opts.KeysOnly = true
+		it := c.Iterate(context.Background(), opts)
+		for it.Next() {
+			n++
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+
+	if output == "json" {
+		fmt.Fprintf(stdout, "{\"count\": %d}\n", n)
+	} else {
+		fmt.Fprintln(stdout, n)
+	}
+	return nil
+}
+
+func batch(c *client.Client, args []string) error {
+	if len(args) > 1 {
+		return usage("batch [file]")
+	}
+
+	in, err := readInput(args)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	b := &client.Batch{}
+	dec := json.NewDecoder(in)
+	for line := 1; ; line++ {
+		op := &struct{ Op, Key, Value string }{}
+		if err := dec.Decode(op); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("op %d: %s", line, err)
+		}
+
+		switch op.Op {
+		case "put":
+			b.Put(op.Key, []byte(op.Value))
+		case "delete":
+			b.Delete(op.Key)
+		default:
+			return fmt.Errorf("op %d: unknown op %q", line, op.Op)
+		}
+	}
+
+	if err := c.Batch(context.Background(), b); err != nil {
+		return err
+	}
+	if output != "raw" {
+		fmt.Fprintf(stdout, "applied %d ops\n", b.Len())
+	}
+	return nil
+}
+
+func property(c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return usage("property <name>")
+	}
+
+	value, err := c.Property(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		b, _ := json.Marshal(map[string]string{"name": args[0], "value": value})
+		fmt.Fprintf(stdout, "%s\n", b)
+	} else {
+		fmt.Fprint(stdout, value)
+	}
+	return nil
+}
+
+func snapshot(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	spec := client.SnapshotSpec{}
+	fs.StringVar(&spec.Prefix, "prefix", "", "only copy keys starting with this")
+	fs.StringVar(&spec.Start, "start", "", "first key to copy (inclusive)")
+	fs.StringVar(&spec.End, "end", "", "last key to copy (exclusive)")
+	fs.StringVar(&spec.StripPrefix, "strip-prefix", "", "remove this from the front of copied keys")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return usage("snapshot [-prefix p] [-start s] [-end e] [-strip-prefix p] <destination>")
+	}
+	spec.Destination = fs.Arg(0)
+
+	return c.Snapshot(context.Background(), spec)
+}
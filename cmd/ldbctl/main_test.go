@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/teepark/ldbrest/client"
+	lib "github.com/teepark/ldbrest/libldbrest"
+)
+
+func TestRangeOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rf   rangeFlags
+		opts client.IterOptions
+		ok   bool
+	}{
+		{
+			name: "plain",
+			rf:   rangeFlags{start: "a", end: "c"},
+			opts: client.IterOptions{Start: "a", End: "c"},
+			ok:   true,
+		},
+		{
+			name: "plain reverse",
+			rf:   rangeFlags{start: "c", end: "a", reverse: true},
+			opts: client.IterOptions{Start: "c", End: "a", Reverse: true},
+			ok:   true,
+		},
+		{
+			name: "prefix",
+			rf:   rangeFlags{prefix: "ab"},
+			opts: client.IterOptions{Start: "ab", End: "ac"},
+			ok:   true,
+		},
+		{
+			name: "prefix with start and end inside",
+			rf:   rangeFlags{prefix: "ab", start: "abc", end: "abd"},
+			opts: client.IterOptions{Start: "abc", End: "abd"},
+			ok:   true,
+		},
+		{
+			name: "prefix with start and end outside",
+			rf:   rangeFlags{prefix: "ab", start: "a", end: "b"},
+			opts: client.IterOptions{Start: "ab", End: "ac"},
+			ok:   true,
+		},
+		{
+			name: "prefix ending in 0xff",
+			rf:   rangeFlags{prefix: "a\xff"},
+			opts: client.IterOptions{Start: "a\xff", End: "b"},
+			ok:   true,
+		},
+		{
+			name: "prefix of only 0xff",
+			rf:   rangeFlags{prefix: "\xff\xff"},
+			opts: client.IterOptions{Start: "\xff\xff"},
+			ok:   true,
+		},
+		{
+			name: "prefix before start",
+			rf:   rangeFlags{prefix: "ab", start: "b"},
+			ok:   false,
+		},
+		{
+			name: "prefix after end",
+			rf:   rangeFlags{prefix: "ab", end: "aa"},
+			ok:   false,
+		},
+		{
+			name: "end at the prefix",
+			rf:   rangeFlags{prefix: "ab", end: "ab"},
+			ok:   false,
+		},
+		{
+			name: "prefix reverse",
+			rf:   rangeFlags{prefix: "ab", reverse: true},
+			opts: client.IterOptions{Start: "ac", ExcludeStart: true, End: "ab", IncludeEnd: true, Reverse: true},
+			ok:   true,
+		},
+		{
+			name: "prefix reverse with start and end inside",
+			rf:   rangeFlags{prefix: "ab", start: "abd", end: "abc", reverse: true},
+			opts: client.IterOptions{Start: "abd", End: "abc", Reverse: true},
+			ok:   true,
+		},
+		{
+			name: "prefix reverse with start and end outside",
+			rf:   rangeFlags{prefix: "ab", start: "b", end: "a", reverse: true},
+			opts: client.IterOptions{Start: "ac", ExcludeStart: true, End: "ab", IncludeEnd: true, Reverse: true},
+			ok:   true,
+		},
+		{
+			name: "prefix reverse with start at the prefix",
+			rf:   rangeFlags{prefix: "ab", start: "ab", reverse: true},
+			opts: client.IterOptions{Start: "ab", End: "ab", IncludeEnd: true, Reverse: true},
+			ok:   true,
+		},
+		{
+			name: "prefix reverse with end at the prefix",
+			rf:   rangeFlags{prefix: "ab", end: "ab", reverse: true},
+			opts: client.IterOptions{Start: "ac", ExcludeStart: true, End: "ab", Reverse: true},
+			ok:   true,
+		},
+		{
+			name: "prefix reverse with start and end equal",
+			rf:   rangeFlags{prefix: "ab", start: "abc", end: "abc", reverse: true},
+			ok:   false,
+		},
+		{
+			name: "prefix reverse past the start",
+			rf:   rangeFlags{prefix: "ab", start: "aa", reverse: true},
+			ok:   false,
+		},
+	} {
+		opts, ok := tc.rf.options()
+		if ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if ok && opts != tc.opts {
+			t.Errorf("%s: options = %+v, want %+v", tc.name, opts, tc.opts)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dirpath, err := ioutil.TempDir("", "ldbctl_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirpath)
+	lib.OpenDB(dirpath + "/db")
+	defer lib.CleanupDB()
+	srv := httptest.NewServer(lib.InitRouter(""))
+	defer srv.Close()
+	c := client.New(srv.Listener.Addr().String())
+
+	defer func(out io.Writer) { stdout = out }(stdout)
+	defer func(o string) { output = o }(output)
+
+	file := func(name, content string) string {
+		path := filepath.Join(dirpath, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	batchFile := file("batch", `{"op": "put", "key": "a/1", "value": "one"}
+{"op": "put", "key": "a/2", "value": "two"}
+{"op": "put", "key": "a/3", "value": "three"}
+{"op": "put", "key": "b", "value": "bee"}
+{"op": "delete", "key": "a/3"}
+`)
+
+	for _, tc := range []struct {
+		format string
+		cmd    func(*client.Client, []string) error
+		args   []string
+		out    string
+	}{
+		{"table", batch, []string{batchFile}, "applied 5 ops\n"},
+		{"raw", put, []string{"c", file("c", "sea")}, ""},
+		{"raw", get, []string{"c"}, "sea"},
+		{"json", get, []string{"c"}, `{"key":"c","value":"sea"}` + "\n"},
+		{"raw", del, []string{"c"}, ""},
+		{"raw", scan, nil, "a/1\tone\na/2\ttwo\nb\tbee\n"},
+		{"raw", scan, []string{"-keys", "-max", "2"}, "a/1\na/2\n"},
+		{"raw", scan, []string{"-prefix", "a/"}, "a/1\tone\na/2\ttwo\n"},
+		{"raw", scan, []string{"-prefix", "a/", "-reverse"}, "a/2\ttwo\na/1\tone\n"},
+		{"raw", scan, []string{"-prefix", "a/", "-start", "a/1", "-reverse"}, "a/1\tone\n"},
+		{"raw", scan, []string{"-prefix", "a/", "-end", "a/1", "-reverse"}, "a/2\ttwo\n"},
+		{"raw", scan, []string{"-start", "b", "-end", "a/1", "-reverse"}, "b\tbee\na/2\ttwo\n"},
+		{"raw", scan, []string{"-prefix", "c"}, ""},
+		{"json", scan, []string{"-prefix", "a/", "-keys"}, `{"key":"a/1"}` + "\n" + `{"key":"a/2"}` + "\n"},
+		{"table", scan, []string{"-prefix", "a/"}, "KEY    VALUE\n\"a/1\"  \"one\"\n\"a/2\"  \"two\"\n"},
+		{"raw", count, nil, "3\n"},
+		{"raw", count, []string{"-prefix", "a/", "-reverse"}, "2\n"},
+		{"json", count, []string{"-prefix", "z"}, `{"count": 0}` + "\n"},
+	} {
+		buf := &bytes.Buffer{}
+		stdout, output = buf, tc.format
+		if err := tc.cmd(c, tc.args); err != nil {
+			t.Fatalf("%v (-o %s): %v", tc.args, tc.format, err)
+		}
+		if buf.String() != tc.out {
+			t.Errorf("%v (-o %s): got %q, want %q", tc.args, tc.format, buf.String(), tc.out)
+		}
+	}
+
+	if _, err := c.Get(context.Background(), "c"); err != client.ErrNotFound {
+		t.Errorf("del didn't delete: %v", err)
+	}
+}
@@ -12,16 +12,175 @@ It is invoked with an optional -s/-serveaddr flag and a required positional
 /path/to/leveldb. "serveaddr" can be a "host:port" for TCP or a
 /path/to/socketfile for a streaming unix domain socket and can be given more
 than once. Without any -s/-serveaddr flags it will serve on "127.0.0.1:7000".
+Every address is bound before any are served, and if one can't be the process
+exits with an error. The bound addresses are logged (so a port of 0 shows the
+one picked), and with -addr-file /path/to/file they're also written to that
+file, one per line.
+
+With -access-log /path/to/file (or "-" for stdout) it writes a line per request
+to an access log, in the format given by -access-log-format: "json" (the
+default) or "combined". JSON lines record the method, route, key or range,
+response code and size, duration, remote address (or unix socket peer uid) and
+authenticated identity, with API tokens shown only by a short fingerprint.
+-access-log-sample 0.1 logs just a tenth of requests, but any taking at least
+-access-log-slow (e.g. "500ms") are always logged. A SIGHUP reopens the file,
+for use with logrotate.
+
+On a SIGINT or SIGTERM it stops accepting connections and gives in-flight
+requests up to -shutdown-timeout (default 30s) to finish, aborting any long
+iterations or snapshots still going after that. Then it closes the database
+and removes its unix socket files before exiting.
+
+With -tls-cert and -tls-key flags (paths to PEM files) the "host:port"
+addresses serve HTTPS, while unix sockets stay plaintext. Adding a
+-tls-client-ca flag requires clients to present a certificate signed by one of
+the CAs in that PEM file, and the verified certificate's common name can be
+used in access control rules (it's an error without -tls-cert and -tls-key,
+rather than serving plaintext). Sending the process a SIGHUP reloads all three
+files without interrupting the servers.
+
+With a -tokens /path/to/tokenfile flag, every request must carry an API token
+in an "Authorization: Bearer <token>" header. Each line of the token file is a
+token and its role separated by whitespace, with blank lines and lines starting
+with "#" ignored. The roles are "read" (GET /key, POST /keys, GET /iterate and
+GET /metrics), "write" (which can also PUT and DELETE /key and POST /batch)
+and "admin" (which can do anything, including /property, /snapshot and
+/restore). Requests with a missing or unknown token get a 401, and those whose
+token's role isn't enough get a 403.
+
+With a -acl /path/to/aclfile flag, access to keys is confined to prefixes.
+Each line of the ACL file is an identity, a comma-separated list of operations
+("read" and/or "write") and an optional key prefix (without one the rule
+covers every key, in every bucket). A prefix of "bucket:<name>/<prefix>" (or
+just "bucket:<name>") covers keys in that bucket instead. Identities are
+"token:<token>" for an API token, "cn:<name>" for the common name of a verified
+TLS client certificate, or "uid:<uid>" for the user at the other end of a unix
+socket. Requests touching a key that none of their identities' rules allow get
+a 403; that goes for every key in a POST /keys or POST /batch too. GET
+/iterate instead passes over the keys it isn't allowed, going through the
+allowed prefixes it reaches one after another.
+
+With -compress <encoding>:<prefix> flags, values of keys under the prefix
+are stored compressed. The only encoding is "gzip", plus "none" to exempt keys
+under a longer prefix from a shorter one's compression (the longest matching
+prefix wins). Values that don't get any smaller, and values stored in chunks,
+are stored uncompressed. Compressed values are sent with Content-Encoding gzip
+to clients whose Accept-Encoding allows it and decompressed for the rest, and
+/keys and /iterate responses are gzipped for clients that accept it whether or
+not the values were stored compressed.
+
+Requests are limited in size by -max-body-size (bytes in any request body,
+default 64MiB), -max-value-size (bytes in a value, default 64MiB),
+-max-key-length (bytes in a key being written, default 64KiB), -max-keys (keys
+in a POST /keys, default 10000) and -max-batch-ops (ops in a POST /batch,
+default 10000). A limit of 0 turns it off. Bodies or values over their limits
+get a 413, other exceeded limits a 400.
+
+Each client (told apart by API token, TLS client certificate, unix socket peer
+uid or else IP address) can be rate limited separately for reads (GET /key,
+POST /keys), writes (PUT and DELETE /key, POST /batch) and scans (GET
+/iterate) with -rate-read, -rate-write and -rate-scan flags, each given as
+"<requests per second>[:<burst>]". -max-expensive caps the number of GET
+/iterate and POST /snapshot requests running at once across all clients.
+Requests over a limit get a 429 with a Retry-After header.
+
+Error responses have a JSON body like
+
+  {"error": {"code": "bad_json", "message": "...", "op_index": 3}}
+
+where "op_index" only appears for errors in a /batch, giving the index of the
+offending op. The codes are "bad_request", "bad_json" (an unparseable request
+body), "bad_param" (an invalid query string parameter), "bad_key" (an invalid
+tuple key), "bad_batch_op", "bad_snapshot" (a /restore source that isn't a
+database) and "limit_exceeded" with 400s, "unauthorized" (401), "forbidden"
+(403), "not_found" (404), "no_txn" (404, a transaction that doesn't exist or
+has expired), "no_bucket" (404), "exists" (409, a /snapshot destination that's
+already there), "txn_conflict" (409, a transaction whose reads have changed
+before its commit), "too_large" (413), "rate_limited" (429), "unavailable"
+(503), and with 500s "db_error" for failures in leveldb itself and "internal"
+for anything else.
+
+With a key_format=tuple query string parameter, keys in GET, HEAD, PUT, PATCH
+and DELETE /key/<name> (and their /b/<bucket> and /txn/<id> forms), GET
+/iterate's "start" and "end" and POST /batch's ops are tuples: JSON arrays
+like ["user", 42, {"$time": "2024-01-01T00:00:00Z"}], where an object with just a "$time" RFC 3339 string is a time (and no other
+objects are allowed). They're stored in an order-preserving encoding
+(FoundationDB's tuple layer), so tuples sort element by element: first by type
+(null, string, nested array, integer, float, false, true, then time), then
+integers and floats numerically, times chronologically, and strings and
+arrays bytewise. Integers and floats being different types, every integer
+sorts before every float, so write 2.0 rather than 2 where they're mixed.
+Integers of any size are kept exactly. GET /iterate returns keys that are
+tuples as arrays, with times in UTC and floats always with a decimal point or
+exponent, and any other keys as strings.
+
+Keys are ordered bytewise unless -comparator picks another order:
+"reverse-bytewise", "numeric-aware" (runs of digits compare by their value, so
+"x9" comes before "x10") or "case-insensitive" (ASCII letters, with keys that
+differ only in case still kept apart). The order is fixed when the database is
+created and recorded in an LDBREST_COMPARATOR file alongside it, and opening or
+restoring a database with a different one fails (databases without the file
+are bytewise). It applies to GET /iterate (whose "start" and "end" are in that
+order, as are POST /snapshot's) and within buckets. A prefix's keys are only
+together in bytewise order, so with another comparator GET /iterate filters
+keys by the ACL one at a time instead of narrowing to a prefix (skipped keys
+don't count towards "max", so this can take longer). Tuple keys only
+keep their order bytewise.
 
 The server offers these endpoints:
 
+  GET /healthz
+Returns a 200 as long as the process is up. With ?deep=yes it also writes,
+reads back and deletes an internal key, and 503s if any of that fails.
+
+  GET /readyz
+Returns a 200 when requests can be served, or a 503 (with the reason in the
+body) while the database is still being opened, is being swapped by /restore,
+or the server is shutting down. Every other endpoint returns a 503 during those
+times as well, but /healthz and /readyz don't require authentication.
+
   GET /key/<name>
 Returns the value associated with the <name> key in the response body with
-content-type text/plain (or 404s).
+the Content-Type it was PUT with (text/plain if none) and its metadata headers,
+or 404s. Responses carry an ETag, and a Last-Modified for values written with
+the -last-modified flag on, and requests with a matching If-None-Match or
+If-Modified-Since get a 304 with no body.
+
+Values support Range requests for reading part of them (with a 206 Partial
+Content response).
+
+  HEAD /key/<name>
+Like GET /key/<name> but without the body, for the value's existence,
+Content-Length and validators.
 
   PUT /key/<name>
 Takes the (unparsed) request body and stores it as the value under key <name>
-and returns a 204.
+and returns a 204. The request's Content-Type and any X-Ldb-Meta-<name>
+headers are stored alongside the value (metadata names are case-insensitive,
+and come back in lower case in /iterate), along with the time it was written
+if -last-modified is on. A value with none of that to store (and no
+compression) is stored just as it was sent, so the db stays readable by other
+LevelDB tools, and keys written before any of it was stored read back
+unchanged.
+
+Values over 1MiB are streamed into 1MiB chunks stored under internal keys
+rather than being held in memory, and only become visible (replacing the
+key's old value and its chunks) once all of them have been written. The last
+8MiB of chunks are written in the same atomic batch as the key itself, and the
+chunks of an upload cut off before then are removed the next time the db is
+opened. They are put back together when read, but are too large for
+secondary indexes.
+
+  PATCH /key/<name>
+Updates the JSON value under key <name> in place. The request body is an RFC
+7386 merge patch (Content-Type application/merge-patch+json) or an RFC 6902
+JSON Patch (application/json-patch+json), and with any other Content-Type a
+JSON array is taken as a JSON Patch and anything else as a merge patch.
+Returns the new document as application/json, a 404 "not_found" if the key
+doesn't exist, a 400 for an invalid patch, or a 409 if the stored value isn't
+JSON or a JSON Patch operation doesn't apply (like a failed "test"). With an
+upsert=yes query string parameter a missing key patches like null instead,
+and is created.
 
   DELETE /key/<name>
 Deletes the key <name> and returns a 204.
@@ -43,7 +202,11 @@ control the iterator:
 * "forward" is whether to iterate forward through sorted order or reverse
 (default "yes", iterate forward)
 
-* "start" is a key to start from (default beginning/end)
+* "start" is a key to start from (default beginning/end). It needn't exist:
+iterating forward begins at the first key after it and in reverse at the last
+key before it, whether or not "include_start" is given (older versions began a
+reverse iteration at the key after a missing "start" when including it, which
+would step outside an ACL's prefixes or a bucket)
 
 * "include_start" is whether to include the key precisely matching "start" if
 it exists (default "yes")
@@ -60,15 +223,123 @@ iteration (default 1000, higher values than this will be ignored)
 * "include_values" is whether to produce {"key": "<key>", "value": "<value>"}
 objects or just "<key>" strings (default "yes")
 
+* "include_meta" is whether to add the "content_type" and "meta" (an object
+of metadata names to values) each key was PUT with to the objects, which it
+produces even without values (default "no")
+
 It then returns a JSON object with two keys "more" and "data". "data" is an
 array of either objects or strings depending on "include_values", while "more"
 is false unless "end" was provided but "max" caused the end of iteration (there
-was still more to go before we would have hit "end").
+was still more to go before we would have hit "end"). When "more" is true there
+is also a "last" key, the key to pass as "start" (with include_start=no) for the
+next page.
 
   POST /batch
 Applies a batch of updates atomically. It accepts a JSON request body with key
 "ops", an array of objects with keys "op", "key", and "value". "op" may be
-"put" or "delete", in the latter case "value" may be omitted.
+"put", "delete" or "patch". For "delete" "value" may be omitted, and for
+"patch" it is the patch (as a string), applied as by PATCH
+/key/<name>?upsert=yes to the value as left by the batch's earlier ops.
+
+  PUT /b/<bucket>
+Creates a bucket, a keyspace of its own apart from the top-level one (which
+holds every key outside a bucket, and is unaffected by buckets) and from
+every other bucket. Bucket names may contain letters, digits, "_", "." and
+"-". It returns a 201 with a JSON object with the bucket's "name", "id" and
+when it was "created", or a 200 with the same if it already existed.
+
+  GET /b/<bucket>/key/<name>
+  HEAD /b/<bucket>/key/<name>
+  PUT /b/<bucket>/key/<name>
+  PATCH /b/<bucket>/key/<name>
+  DELETE /b/<bucket>/key/<name>
+  GET /b/<bucket>/iterate
+Work like their /key/<name> and /iterate counterparts in the bucket, and 404
+with "no_bucket" if it doesn't exist. Iterations stay within the bucket.
+
+  GET /b/<bucket>/stats
+Returns the bucket's JSON object from PUT with the number of "keys" in it and
+their "size" in bytes as stored. With an ACL it 403s unless the client has a
+read rule covering some of the bucket.
+
+  DELETE /b/<bucket>
+Drops the bucket and deletes all its keys, and returns a 204.
+
+  GET /buckets
+Returns a JSON array of the buckets, each as in the PUT response. With an ACL
+only the buckets the client has a read rule for are listed.
+
+  POST /txn
+Opens an optimistic transaction for reading and then writing keys across
+several requests, and returns a 201 with a JSON object with its "id" and the
+"timeout" in seconds after which it expires if unused (set by the
+-txn-timeout flag, default 30s). Only the client that opened a transaction can
+use it.
+
+  GET /txn/<id>/key/<name>
+  PUT /txn/<id>/key/<name>
+  DELETE /txn/<id>/key/<name>
+  GET /txn/<id>/b/<bucket>/key/<name>
+  PUT /txn/<id>/b/<bucket>/key/<name>
+  DELETE /txn/<id>/b/<bucket>/key/<name>
+Work like their /key/<name> and /b/<bucket>/key/<name> counterparts within
+the transaction. Reads see the database as it was when the transaction was
+opened, along with the transaction's own writes, which are held back until
+it's committed. One transaction can cover keys in any number of buckets.
+
+  POST /txn/<id>/commit
+Applies the transaction's writes in one atomic batch and returns a 204, unless
+any key it read has changed since it was opened (its value, Content-Type or
+metadata, not just being written again the same), in which case nothing is
+written and it 409s. Either way the transaction is over. Values are stored as
+by PUT /key/<name>, so large ones are chunked.
+
+  DELETE /txn/<id>
+Abandons the transaction, and returns a 204.
+
+  PUT /index/<name>
+Declares a secondary index over JSON values. It takes a JSON request body with
+keys "prefix" (which keys to index, default all of them) and "path", a dotted
+path into each value like "user.email" or "tags.0". Every key under the prefix
+whose value is a JSON document with a string, number, boolean or null at the
+path gets an index entry, and PUT, DELETE and /batch keep the entries up to
+date in the same atomic write as the values. Entries for existing data are
+built by a job in the background: the 202 response (and GET /indexes) reports
+its "state" ("running", "done", "failed" or "cancelled") and how many keys it
+has "scanned" so far. Redeclaring an index rebuilds it. Only top-level keys
+can be indexed, not those in buckets: a prefix in ldbrest's own keyspace
+(where buckets keep their keys) is a 400 "bad_json".
+
+  POST /index/<name>/rebuild
+Starts the index's background build over again, and returns a 202 like PUT.
+
+  DELETE /index/<name>
+Drops the index and all its entries, and returns a 204.
+
+  GET /indexes
+Returns a JSON array of the declared indexes, each with its "name", "prefix",
+"path" and the "rebuild" status of its latest background build. With an ACL
+only indexes over keys the client may read some of are listed.
+
+  GET /index/<name>
+Looks up keys by the values in an index. Values in the query string are read
+as JSON if they parse that way and as plain strings otherwise, so 42 is a
+number while "42" and abc are strings. It takes query string parameters:
+
+* "value" finds the keys with exactly this value
+
+* "start" and "end" instead find the keys with values in a range, including
+"start" but not "end" unless "include_start" is "no" or "include_end" is "yes".
+Index values sort null, false, true, then numbers, then strings.
+
+* "max" is a maximum number of keys to return (default and limit 1000)
+
+* "include_values" is whether to include each key's value (default "yes")
+
+* "after" continues a previous lookup from its "next"
+
+It returns a JSON object with "more", "next" (when there is more) and "data",
+an array of objects with keys "key", "index_value" and "value".
 
   GET /property/<name>
 Gets and returns the leveldb property in the text/plain 200 response body, or
@@ -79,6 +350,53 @@ Needs a JSON request body with key "destination", which should be a file system
 path. ldbrest will make a complete copy of the database at that location, then
 return a 204 (after what might be a while).
 
+The copy can be limited with optional keys in the request body:
+
+* "prefix" only copies keys beginning with this string
+
+* "start" is the first key to copy (inclusive)
+
+* "end" is the key at which to stop copying (exclusive)
+
+* "strip_prefix" is removed from the front of each copied key, so "prefix":
+"tenant1/", "strip_prefix": "tenant1/" carves a tenant's keys out into a
+database of their own. It must be the start of "prefix" (so that every copied
+key has it and none can collide), and a key that is just the strip_prefix is
+left out
+
+A limited copy only has client keys: ldbrest's own (index entries, bucket
+definitions and bucket keys) are left out, except for the pieces of large
+values it copies.
+
+  POST /restore
+Swaps the served database for a snapshot. It takes a JSON request body with
+key "source", the path of a database made by /snapshot (a bare name is looked
+for in the same directory as the served database). The snapshot is copied
+into place, so it's left as it was and can be restored again, and the database
+it replaces is kept alongside with a ".prev" suffix. With {"undo": true}
+instead, the ".prev" database is swapped back in. Other requests get a 503
+with a Retry-After header while the swap happens (but not during the copy).
+If the process dies in the middle of a swap, the next start finishes or undoes
+it before opening the database. Returns a 204, or a 404 for an undo with no
+previous database.
+
+  GET /limits
+Returns the request size limits in effect as a JSON object with keys
+"max_body_size", "max_value_size", "max_key_length", "max_keys" and
+"max_batch_ops". It requires an admin token when authentication is on.
+
+  GET /metrics
+Returns metrics in the prometheus text format: request counts (by route,
+method and response code) and latencies (by route and method), bytes of values
+read and written, keys returned by /iterate, /batch sizes and /snapshot
+durations, plus gauges from the "leveldb.num-files-at-level<N>" and
+"leveldb.stats" properties.
+
+A Go client for all of these is in the github.com/teepark/ldbrest/client
+package, and the ldbctl command (github.com/teepark/ldbrest/cmd/ldbctl) uses it
+to get, put, delete, scan, count, batch, snapshot and read properties from the
+command line.
+
 [1] https://github.com/google/leveldb
 */
 package main
@@ -0,0 +1,162 @@
+package libldbrest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLog is where access log lines go, or nil for no access logging
+var accessLog struct {
+	sync.Mutex
+	out    io.Writer
+	format string
+	sample float64
+	slow   time.Duration
+}
+
+// SetAccessLog turns on access logging to out, which must be safe for
+// concurrent use. Each line is written with a single Write.
+//
+// format is "json" (one object per line) or "combined" (the apache/nginx
+// format). Each request is logged with probability sample (0 to 1), except
+// that requests taking slow or longer are always logged if slow is nonzero.
+func SetAccessLog(out io.Writer, format string, sample float64, slow time.Duration) error {
+	if format != "json" && format != "combined" {
+		return fmt.Errorf("unknown access log format %q", format)
+	}
+
+	accessLog.Lock()
+	defer accessLog.Unlock()
+	accessLog.out = out
+	accessLog.format = format
+	accessLog.sample = sample
+	accessLog.slow = slow
+	return nil
+}
+
+// reqInfo gathers the details of a request that only its handler knows
+type reqInfo struct {
+	target string // the key or range the request was for
+	token  string // the API token it authenticated with
+}
+
+const reqInfoKey ctxKey = peerUIDKey + 1
+
+func withReqInfo(r *http.Request) (*http.Request, *reqInfo) {
+	info := &reqInfo{}
+	return r.WithContext(context.WithValue(r.Context(), reqInfoKey, info)), info
+}
+
+// noteTarget records what a request was for, for its access log line
+func noteTarget(r *http.Request, format string, args ...interface{}) {
+	if info, ok := r.Context().Value(reqInfoKey).(*reqInfo); ok {
+		info.target = fmt.Sprintf(format, args...)
+	}
+}
+
+// noteToken records the API token a request authenticated with
+func noteToken(r *http.Request, token string) {
+	if info, ok := r.Context().Value(reqInfoKey).(*reqInfo); ok {
+		info.token = token
+	}
+}
+
+// logIdentity describes who made the request. tokens are secrets so they
+// are logged by a short fingerprint rather than in full.
+func logIdentity(r *http.Request, info *reqInfo) string {
+	var ids []string
+	if info.token != "" {
+		sum := sha256.Sum256([]byte(info.token))
+		ids = append(ids, "token:"+hex.EncodeToString(sum[:4]))
+	}
+	if cn, ok := clientCN(r); ok {
+		ids = append(ids, "cn:"+cn)
+	}
+	if uid, ok := peerUID(r); ok {
+		ids = append(ids, "uid:"+strconv.Itoa(uid))
+	}
+	return strings.Join(ids, " ")
+}
+
+func logRemote(r *http.Request) string {
+	if uid, ok := peerUID(r); ok {
+		return "unix:uid=" + strconv.Itoa(uid)
+	}
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "unix"
+	}
+	return r.RemoteAddr
+}
+
+// logAccess writes a request's access log line, putting it together
+// outside the lock so that requests aren't held up by each other's logging
+func logAccess(r *http.Request, route string, info *reqInfo, sr *statusRecorder, start time.Time) {
+	accessLog.Lock()
+	out, format, sample, slowAfter := accessLog.out, accessLog.format, accessLog.sample, accessLog.slow
+	accessLog.Unlock()
+	if out == nil {
+		return
+	}
+
+	took := time.Since(start)
+	slow := slowAfter > 0 && took >= slowAfter
+	if !slow && rand.Float64() >= sample {
+		return
+	}
+
+	remote := logRemote(r)
+	identity := logIdentity(r, info)
+
+	if format == "combined" {
+		user := identity
+		if user == "" {
+			user = "-"
+		}
+		out.Write([]byte(fmt.Sprintf("%s - %s [%s] %q %d %d %q %q\n",
+			remote,
+			strings.Replace(user, " ", ",", -1),
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+			sr.status(),
+			sr.bytes,
+			r.Referer(),
+			r.UserAgent(),
+		)))
+		return
+	}
+
+	line, _ := json.Marshal(&struct {
+		Time     string  `json:"time"`
+		Method   string  `json:"method"`
+		Route    string  `json:"route"`
+		Target   string  `json:"target,omitempty"`
+		Status   int     `json:"status"`
+		Bytes    int     `json:"bytes"`
+		Duration float64 `json:"duration_ms"`
+		Remote   string  `json:"remote"`
+		Identity string  `json:"identity,omitempty"`
+		Slow     bool    `json:"slow,omitempty"`
+	}{
+		start.UTC().Format(time.RFC3339Nano),
+		r.Method,
+		route,
+		info.target,
+		sr.status(),
+		sr.bytes,
+		float64(took) / float64(time.Millisecond),
+		remote,
+		identity,
+		slow,
+	})
+	out.Write(append(line, '\n'))
+}
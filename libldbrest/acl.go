@@ -0,0 +1,366 @@
+package libldbrest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// aclOp is a kind of key access an ACL rule can grant
+type aclOp int
+
+const (
+	aclRead aclOp = 1 << iota
+	aclWrite
+)
+
+var aclOpNames = map[string]aclOp{
+	"read":  aclRead,
+	"write": aclWrite,
+}
+
+func (op aclOp) String() string {
+	if op == aclWrite {
+		return "write"
+	}
+	return "read"
+}
+
+type aclRule struct {
+	ops    aclOp
+	prefix []byte
+}
+
+// rules about a bucket's keys have prefixes starting with aclBucketPrefix,
+// and are checked against its keys with that prefix in place of the bucket's
+// own. rules with no prefix at all cover every bucket too.
+func aclBucketPrefix(name string) []byte {
+	return internalKey("bucket:" + name + "/")
+}
+
+// aclKey is what ACL rules are checked against for a stored key
+// (or nil for a key in a bucket that doesn't exist)
+func aclKey(key []byte) []byte {
+	if def, bkey, ok := splitBucketKey(key); ok {
+		if def == nil {
+			return nil
+		}
+		return append(aclBucketPrefix(def.Name), bkey...)
+	}
+	return key
+}
+
+// acl maps identities ("token:<token>", "cn:<common name>" or "uid:<uid>")
+// to the rules granting them access to keys.
+// while it is nil access control is disabled and every key is allowed.
+var acl map[string][]aclRule
+
+// LoadACL reads access control rules from a file and turns on prefix-scoped
+// access control.
+//
+// Each non-blank line of the file is an identity, a comma-separated list of
+// operations ("read", "write") and optionally a key prefix, separated by
+// whitespace. Without a prefix the rule covers every key, in every bucket. A
+// prefix of "bucket:<name>/<prefix>" (or just "bucket:<name>") covers keys
+// in the bucket instead of the top-level keyspace. An identity is one
+// of "token:<token>", "cn:<client cert common name>" or "uid:<unix socket
+// peer uid>". Lines starting with "#" are ignored.
+func LoadACL(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	loaded := make(map[string][]aclRule)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected \"<identity> <ops> [<prefix>]\"", path, lineno)
+		}
+
+		id := fields[0]
+		if !strings.HasPrefix(id, "token:") && !strings.HasPrefix(id, "cn:") && !strings.HasPrefix(id, "uid:") {
+			return fmt.Errorf("%s:%d: unknown identity type %q", path, lineno, id)
+		}
+
+		rule := aclRule{}
+		for _, name := range strings.Split(fields[1], ",") {
+			op, ok := aclOpNames[name]
+			if !ok {
+				return fmt.Errorf("%s:%d: unknown operation %q", path, lineno, name)
+			}
+			rule.ops |= op
+		}
+		switch {
+		case len(fields) == 2:
+		case strings.HasPrefix(fields[2], "bucket:"):
+			name, prefix := strings.TrimPrefix(fields[2], "bucket:"), ""
+			if i := strings.Index(name, "/"); i >= 0 {
+				name, prefix = name[:i], name[i+1:]
+			}
+			if !validBucketName.MatchString(name) {
+				return fmt.Errorf("%s:%d: invalid bucket name %q", path, lineno, name)
+			}
+			rule.prefix = append(aclBucketPrefix(name), prefix...)
+		default:
+			rule.prefix = []byte(fields[2])
+		}
+
+		loaded[id] = append(loaded[id], rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	acl = loaded
+	return nil
+}
+
+// identities lists every identity a request can be matched by
+func identities(r *http.Request) []string {
+	var ids []string
+	if tok := requestToken(r); tok != "" {
+		ids = append(ids, "token:"+tok)
+	}
+	if cn, ok := clientCN(r); ok {
+		ids = append(ids, "cn:"+cn)
+	}
+	if uid, ok := peerUID(r); ok {
+		ids = append(ids, "uid:"+strconv.Itoa(uid))
+	}
+	return ids
+}
+
+// keyAllowed reports whether the request may perform op on (stored) key
+func keyAllowed(r *http.Request, op aclOp, key []byte) bool {
+	if acl == nil {
+		return true
+	}
+
+	if key = aclKey(key); key == nil {
+		return false
+	}
+
+	for _, id := range identities(r) {
+		for _, rule := range acl[id] {
+			if rule.ops&op != 0 && bytes.HasPrefix(key, rule.prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkKey 403s (and returns false) if the request may not perform op on key
+// (nobody may touch ldbrest's internal keys directly, other than buckets')
+func checkKey(w http.ResponseWriter, r *http.Request, op aclOp, key []byte) bool {
+	if (!isInternal(key) || isBucketKey(key)) && keyAllowed(r, op, key) {
+		return true
+	}
+	log.Printf("acl: rejected %s of %q from %s (%s)", op, key, r.RemoteAddr, strings.Join(identities(r), ", "))
+	failCode(w, http.StatusForbidden)
+	return false
+}
+
+// bucketAllowed reports whether the request may perform op on any of the
+// named bucket's keys, which is when allowedRanges for it isn't empty. it
+// goes by the name so a bucket that doesn't exist is refused the same way.
+func bucketAllowed(r *http.Request, op aclOp, name string) bool {
+	if acl == nil {
+		return true
+	}
+	for _, id := range identities(r) {
+		for _, rule := range acl[id] {
+			if rule.ops&op != 0 && (len(rule.prefix) == 0 || bytes.HasPrefix(rule.prefix, aclBucketPrefix(name))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkBucket 403s (and returns false) if the request may not perform op on
+// any of the named bucket's keys
+func checkBucket(w http.ResponseWriter, r *http.Request, op aclOp, name string) bool {
+	if bucketAllowed(r, op, name) {
+		return true
+	}
+	log.Printf("acl: rejected %s of bucket %q from %s (%s)", op, name, r.RemoteAddr, strings.Join(identities(r), ", "))
+	failCode(w, http.StatusForbidden)
+	return false
+}
+
+// keyRange is the keys k with start <= k < end (a nil end is unbounded)
+type keyRange struct {
+	start, end []byte
+}
+
+// prefixEnd is the first key after all those beginning with prefix,
+// or nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// allowedRanges produces the sorted, non-overlapping (stored) key ranges
+// the request may perform op on, in a bucket or (for nil) the top level
+func allowedRanges(r *http.Request, op aclOp, bucket *bucketDef) []keyRange {
+	if acl == nil {
+		return []keyRange{{}}
+	}
+
+	var ranges []keyRange
+	for _, id := range identities(r) {
+		for _, rule := range acl[id] {
+			if rule.ops&op == 0 {
+				continue
+			}
+			switch {
+			case bucket == nil && !isInternal(rule.prefix):
+				ranges = append(ranges, keyRange{rule.prefix, prefixEnd(rule.prefix)})
+			case bucket == nil:
+				// a bucket's rule
+			case len(rule.prefix) == 0:
+				ranges = append(ranges, keyRange{bucket.prefix(), prefixEnd(bucket.prefix())})
+			case bytes.HasPrefix(rule.prefix, aclBucketPrefix(bucket.Name)):
+				start := bucket.key(rule.prefix[len(aclBucketPrefix(bucket.Name)):])
+				ranges = append(ranges, keyRange{start, prefixEnd(start)})
+			}
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	merged := ranges[:0]
+	for _, kr := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.end == nil || bytes.Compare(kr.start, last.end) <= 0 {
+				if last.end != nil && (kr.end == nil || bytes.Compare(kr.end, last.end) > 0) {
+					last.end = kr.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, kr)
+	}
+	return merged
+}
+
+// prefixAllowed reports whether the request may perform op on any of the
+// top-level keys starting with prefix
+func prefixAllowed(r *http.Request, op aclOp, prefix []byte) bool {
+	end := prefixEnd(prefix)
+	for _, kr := range allowedRanges(r, op, nil) {
+		if (end == nil || bytes.Compare(kr.start, end) < 0) && (kr.end == nil || bytes.Compare(kr.end, prefix) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// iterBounds describes where an iteration starts and stops
+type iterBounds struct {
+	start, end                            []byte
+	include_start, include_end, backwards bool
+}
+
+// split divides the iteration into one part per range it passes through,
+// in the order it reaches them, so that it can carry on from one allowed
+// range to the next without seeing the keys between them
+func (ib *iterBounds) split(ranges []keyRange) []*iterBounds {
+	var parts []*iterBounds
+	for i := range ranges {
+		kr := ranges[i]
+		if ib.backwards {
+			kr = ranges[len(ranges)-1-i]
+		}
+		if ib.pastEnd(kr) {
+			break
+		}
+		part := *ib
+		if part.clamp([]keyRange{kr}) {
+			parts = append(parts, &part)
+		}
+	}
+	return parts
+}
+
+// pastEnd reports whether the iteration ends before it reaches kr
+func (ib *iterBounds) pastEnd(kr keyRange) bool {
+	if len(ib.end) == 0 {
+		return false
+	}
+	if ib.backwards {
+		return kr.end != nil && bytes.Compare(kr.end, ib.end) <= 0
+	}
+	cmp := bytes.Compare(kr.start, ib.end)
+	return cmp > 0 || cmp == 0 && !ib.include_end
+}
+
+// clamp narrows the iteration to the first of ranges it reaches. it returns
+// false if the iteration doesn't reach any of them.
+func (ib *iterBounds) clamp(ranges []keyRange) bool {
+	if len(ranges) == 1 && ranges[0].start == nil && ranges[0].end == nil {
+		return true
+	}
+
+	if ib.backwards {
+		// the last range starting at or before "start"
+		i := len(ranges) - 1
+		if len(ib.start) > 0 {
+			i = sort.Search(len(ranges), func(i int) bool {
+				return bytes.Compare(ranges[i].start, ib.start) > 0
+			}) - 1
+		}
+		if i < 0 {
+			return false
+		}
+		kr := ranges[i]
+
+		if kr.end != nil && (len(ib.start) == 0 || bytes.Compare(ib.start, kr.end) >= 0) {
+			ib.start, ib.include_start = kr.end, false
+		}
+		if len(ib.end) == 0 || bytes.Compare(ib.end, kr.start) < 0 {
+			ib.end, ib.include_end = kr.start, true
+		}
+		return true
+	}
+
+	// the first range ending after "start"
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].end == nil || bytes.Compare(ranges[i].end, ib.start) > 0
+	})
+	if i == len(ranges) {
+		return false
+	}
+	kr := ranges[i]
+
+	if bytes.Compare(ib.start, kr.start) < 0 {
+		ib.start, ib.include_start = kr.start, true
+	}
+	if kr.end != nil && (len(ib.end) == 0 || bytes.Compare(ib.end, kr.end) > 0) {
+		ib.end, ib.include_end = kr.end, false
+	}
+	return true
+}
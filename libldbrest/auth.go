@@ -0,0 +1,129 @@
+package libldbrest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// role is the level of access an API token grants, each includes the ones
+// before it (a write token can also read, an admin token can do anything)
+type role int
+
+const (
+	roleNone role = iota
+	roleRead
+	roleWrite
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"read":  roleRead,
+	"write": roleWrite,
+	"admin": roleAdmin,
+}
+
+func (rl role) String() string {
+	for name, r := range roleNames {
+		if r == rl {
+			return name
+		}
+	}
+	return "none"
+}
+
+// tokens maps API tokens to the roles they carry.
+// while it is nil authentication is disabled and every request is allowed.
+var tokens map[string]role
+
+// LoadTokens reads API tokens from a file and turns on authentication.
+//
+// Each non-blank line of the file holds a token and its role ("read",
+// "write" or "admin") separated by whitespace. Lines starting with "#" are
+// ignored.
+func LoadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	loaded := make(map[string]role)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"<token> <role>\"", path, lineno)
+		}
+		rl, ok := roleNames[fields[1]]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown role %q", path, lineno, fields[1])
+		}
+		loaded[fields[0]] = rl
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	tokens = loaded
+	return nil
+}
+
+type ctxKey int
+
+const tokenKey ctxKey = iota
+
+// requestToken is the API token the request authenticated with, if any
+func requestToken(r *http.Request) string {
+	tok, _ := r.Context().Value(tokenKey).(string)
+	return tok
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authed wraps an endpoint so it can only be used with a token of (at least)
+// the given role. it 401s missing or unknown tokens and 403s weaker ones.
+func authed(need role, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if tokens == nil {
+			h(w, r, p)
+			return
+		}
+
+		tok := bearerToken(r)
+		has, ok := tokens[tok]
+		if ok {
+			noteToken(r, tok)
+		}
+		if !ok {
+			log.Printf("auth: rejected %s %s from %s: missing or unknown token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ldbrest"`)
+			failCode(w, http.StatusUnauthorized)
+			return
+		}
+		if has < need {
+			log.Printf("auth: rejected %s %s from %s: %s token, needs %s", r.Method, r.URL.Path, r.RemoteAddr, has, need)
+			failCode(w, http.StatusForbidden)
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenKey, tok)), p)
+	}
+}
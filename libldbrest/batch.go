@@ -1,30 +1,79 @@
 package libldbrest
 
 import (
-	"errors"
-	"github.com/jmhodges/levigo"
+	"fmt"
 )
 
+// ops are "put" (of Value), "delete", or "patch" (with
+// Value a merge patch or JSON Patch document)
 type oplist []*struct {
 	Op, Key, Value string
 }
 
-var errBadBatch = errors.New("bad write batch")
+// badBatchOp describes what's wrong with the op at index i of a batch
+func badBatchOp(i int, msg string) *apiError {
+	return &apiError{Code: codeBadBatchOp, Message: msg, OpIndex: &i}
+}
 
+// applyBatch writes ops atomically. if any of them is invalid
+// nothing is written and the error is an *apiError saying which.
 func applyBatch(ops oplist) error {
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
+	w := newWriter()
+	defer w.close()
+
+	var err error
+	for i, op := range ops {
+		if op == nil {
+			return badBatchOp(i, "op must be an object")
+		}
+
+		if msg := keyLengthErr([]byte(op.Key)); msg != "" {
+			return &apiError{Code: codeLimitExceeded, Message: msg, OpIndex: &i}
+		}
 
-	for _, op := range ops {
 		switch op.Op {
 		case "put":
-			wb.Put([]byte(op.Key), []byte(op.Value))
+			if msg := valueSizeErr([]byte(op.Value)); msg != "" {
+				return &apiError{Code: codeLimitExceeded, Message: msg, OpIndex: &i}
+			}
+			err = w.putValue([]byte(op.Key), &valueHeader{}, []byte(op.Value))
 		case "delete":
-			wb.Delete([]byte(op.Key))
+			err = w.del([]byte(op.Key))
+		case "patch":
+			err = patchOp(w, i, []byte(op.Key), []byte(op.Value))
 		default:
-			return errBadBatch
+			return badBatchOp(i, fmt.Sprintf("unknown op %q (must be \"put\", \"delete\" or \"patch\")", op.Op))
+		}
+		if err != nil {
+			return err
 		}
 	}
 
-	return db.Write(wo, wb)
+	return w.commit()
+}
+
+// patchOp patches a key's value (as of the batch's earlier ops) for
+// the op at index i of a batch
+func patchOp(w *writer, i int, key, patch []byte) error {
+	stored, err := w.current(key)
+	if err != nil {
+		return err
+	}
+	h, value, err := loadValue(ro, stored)
+	if err != nil {
+		return err
+	}
+
+	doc, err := applyPatch(value, patch, "")
+	if ae, ok := err.(*apiError); ok {
+		ae.OpIndex = &i
+		return ae
+	} else if err != nil {
+		return err
+	}
+	if msg := valueSizeErr(doc); msg != "" {
+		return &apiError{Code: codeLimitExceeded, Message: msg, OpIndex: &i}
+	}
+
+	return w.putValue(key, h, doc)
 }
@@ -0,0 +1,271 @@
+package libldbrest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmhodges/levigo"
+	"github.com/julienschmidt/httprouter"
+)
+
+// bucketDef declares a bucket, a keyspace of its own apart from the
+// top-level one and every other bucket's
+type bucketDef struct {
+	Name    string    `json:"name"`
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+}
+
+var (
+	bucketMu sync.RWMutex
+
+	// by name, and by id
+	buckets   = make(map[string]*bucketDef)
+	bucketIDs = make(map[string]*bucketDef)
+)
+
+var validBucketName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// a bucket's keys live in the internal keyspace, each behind its bucket's
+// prefix. the prefix is by the bucket's id rather than its name: ids are all
+// the same length so no prefix is a prefix of another, and a bucket dropped
+// and created again doesn't see any of its old keys.
+func bucketDefKey(name string) []byte {
+	return internalKey("bucketdef/" + name)
+}
+
+const bucketIDLen = 32
+
+var bucketKeysPrefix = internalKey("b/")
+
+func (def *bucketDef) prefix() []byte {
+	return append(append([]byte{}, bucketKeysPrefix...), def.ID+"/"...)
+}
+
+// floor sorts just before all the bucket's keys. the prefix itself is where
+// the bucket's empty key is stored, which needn't come first with a custom
+// comparator.
+func (def *bucketDef) floor() []byte {
+	prefix := def.prefix()
+	return prefix[:len(prefix)-1]
+}
+
+// key is where the bucket stores key
+func (def *bucketDef) key(key []byte) []byte {
+	return append(def.prefix(), key...)
+}
+
+// splitBucketKey finds the bucket a stored key belongs to and the key within
+// it. ok is false for keys that aren't in a bucket, and def is nil for keys
+// of a bucket that's since been dropped.
+func splitBucketKey(stored []byte) (def *bucketDef, key []byte, ok bool) {
+	if !bytes.HasPrefix(stored, bucketKeysPrefix) || len(stored) < len(bucketKeysPrefix)+bucketIDLen+1 {
+		return nil, nil, false
+	}
+	id := string(stored[len(bucketKeysPrefix) : len(bucketKeysPrefix)+bucketIDLen])
+	key = stored[len(bucketKeysPrefix)+bucketIDLen+1:]
+
+	bucketMu.RLock()
+	defer bucketMu.RUnlock()
+	return bucketIDs[id], key, true
+}
+
+// isBucketKey reports whether a stored key is in a bucket that exists
+func isBucketKey(stored []byte) bool {
+	def, _, ok := splitBucketKey(stored)
+	return ok && def != nil
+}
+
+// loadBuckets reads the bucket definitions out of the db
+func loadBuckets() error {
+	loaded := make(map[string]*bucketDef)
+	ids := make(map[string]*bucketDef)
+
+	it := db.NewIterator(ro)
+	defer it.Close()
+
+	prefix := bucketDefKey("")
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		def := &bucketDef{}
+		if err := json.Unmarshal(it.Value(), def); err != nil {
+			return err
+		}
+		loaded[def.Name] = def
+		ids[def.ID] = def
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+
+	bucketMu.Lock()
+	buckets, bucketIDs = loaded, ids
+	bucketMu.Unlock()
+	return nil
+}
+
+func listBuckets() []*bucketDef {
+	bucketMu.RLock()
+	defer bucketMu.RUnlock()
+
+	defs := make([]*bucketDef, 0, len(buckets))
+	for _, def := range buckets {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+func getBucket(name string) *bucketDef {
+	bucketMu.RLock()
+	defer bucketMu.RUnlock()
+	return buckets[name]
+}
+
+// createBucket makes a new bucket, or returns the one already by that name
+// (and false)
+func createBucket(name string) (*bucketDef, bool, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if def := getBucket(name); def != nil {
+		return def, false, nil
+	}
+
+	def := &bucketDef{Name: name, ID: randomID(), Created: time.Now().UTC()}
+	b, err := json.Marshal(def)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := db.Put(wo, bucketDefKey(name), b); err != nil {
+		return nil, false, err
+	}
+
+	bucketMu.Lock()
+	buckets[name] = def
+	bucketIDs[def.ID] = def
+	bucketMu.Unlock()
+	return def, true, nil
+}
+
+// dropBucket removes a bucket's definition and then all its keys. writes to
+// the bucket are refused as soon as the definition is gone, so none can land
+// behind the range delete.
+func dropBucket(ctx context.Context, def *bucketDef) error {
+	writeMu.Lock()
+	err := db.Delete(wo, bucketDefKey(def.Name))
+	if err == nil {
+		bucketMu.Lock()
+		delete(buckets, def.Name)
+		delete(bucketIDs, def.ID)
+		bucketMu.Unlock()
+	}
+	writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	prefix := def.prefix()
+	_, err = eachChunk(ctx, def.floor(), prefixEnd(prefix), oneChunk, func(wb *levigo.WriteBatch, key, value []byte) {
+		if h, _ := decodeValue(value); h.Chunks != nil {
+			dropChunks(wb, h.Chunks)
+		}
+		wb.Delete(key)
+	})
+	return err
+}
+
+// bucketStats summarizes a bucket's contents
+type bucketStats struct {
+	*bucketDef
+	Keys int64 `json:"keys"`
+
+	// bytes of keys and values, as stored
+	Size int64 `json:"size"`
+}
+
+func statBucket(ctx context.Context, def *bucketDef) (*bucketStats, error) {
+	ropts := levigo.NewReadOptions()
+	defer ropts.Close()
+	ropts.SetFillCache(false)
+
+	it := db.NewIterator(ropts)
+	defer it.Close()
+
+	stats := &bucketStats{bucketDef: def}
+	prefix := def.prefix()
+	for it.Seek(def.floor()); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		stats.Keys++
+		stats.Size += int64(len(it.Key()) - len(prefix) + len(it.Value()))
+		if h, _ := decodeValue(it.Value()); h.Chunks != nil {
+			stats.Size += h.Chunks.Size
+		}
+	}
+	return stats, it.GetError()
+}
+
+// inBucket moves an iteration's bounds into a bucket's keys, and bounds it
+// by them where it was unbounded
+func (ib *iterBounds) inBucket(def *bucketDef) {
+	prefix := def.prefix()
+	start, end := ib.start, ib.end
+	ib.start, ib.end = def.key(start), def.key(end)
+
+	if ib.backwards {
+		if len(start) == 0 {
+			ib.start, ib.include_start = prefixEnd(prefix), false
+		}
+		if len(end) == 0 {
+			ib.end, ib.include_end = def.floor(), false
+		}
+		return
+	}
+	if len(start) == 0 && keyOrder.custom() {
+		ib.start = def.floor()
+	}
+	if len(end) == 0 {
+		ib.end, ib.include_end = prefixEnd(prefix), false
+	}
+}
+
+// errNoBucket is for writes to a bucket that doesn't exist (any more)
+var errNoBucket = &apiError{Code: codeNoBucket, Message: "no such bucket", status: http.StatusNotFound}
+
+// routeKey is the stored key a /key/<name> or /b/<bucket>/key/<name> request
+// is about. it 404s (and returns false) if the bucket doesn't exist, and 400s
+// for a name that isn't a tuple when it should be.
+func routeKey(w http.ResponseWriter, r *http.Request, p httprouter.Params) ([]byte, bool) {
+	key := []byte(p.ByName("name")[1:])
+	name := p.ByName("bucket")
+	if name == "" {
+		noteTarget(r, "%s", key)
+	} else {
+		noteTarget(r, "%s:%s", name, key)
+	}
+
+	if tupleKeys(r) {
+		var err error
+		if key, err = parseTupleKey(key); err != nil {
+			failBadRequest(w, codeBadKey, err.Error())
+			return nil, false
+		}
+	}
+	if name == "" {
+		return key, true
+	}
+
+	def := getBucket(name)
+	if def == nil {
+		fail(w, http.StatusNotFound, errNoBucket)
+		return nil, false
+	}
+	return def.key(key), true
+}
@@ -0,0 +1,267 @@
+package libldbrest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/jmhodges/levigo"
+)
+
+// valueChunkSize is the most PUT stores under a key in one piece. larger
+// values go into chunks of this size in the internal keyspace, with just a
+// header describing them under the key itself.
+const valueChunkSize = 1 << 20
+
+// chunkInfo describes a chunked value
+type chunkInfo struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+func (c *chunkInfo) count() int64 {
+	return (c.Size + c.ChunkSize - 1) / c.ChunkSize
+}
+
+// randomID makes an id for something that needs its own. every chunked
+// value gets one, so that a value's chunks can be written before the key's
+// header makes them visible (and the chunks of the value it replaces are
+// deleted).
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func chunkKey(id string, i int64) []byte {
+	key := internalKey("chunk/" + id + "/")
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(i))
+	return append(key, n[:]...)
+}
+
+// an upload's marker is stored from when it first writes any chunks until
+// the batch with the header making them visible, so one still in the db
+// when it's opened is from an upload that was cut off
+func uploadKey(id string) []byte {
+	return internalKey("upload/" + id)
+}
+
+var errChunkMissing = errors.New("chunk of value is missing")
+
+// chunksPerWrite is how many chunks an upload holds in memory before
+// writing them out in a batch
+const chunksPerWrite = 8
+
+// chunkUpload is a value being stored in chunks. the chunks are written a
+// batch at a time as they're read, except for the last batch's worth which
+// finish adds to the batch writing the header, so a value of up to
+// chunksPerWrite chunks is written all at once.
+type chunkUpload struct {
+	info *chunkInfo
+
+	// chunks read but not written yet, the last of them so far
+	pending [][]byte
+
+	// whether any have been written
+	started bool
+}
+
+// uploadChunks reads a value from r into chunks. the upload has to be
+// finished, or discarded if that never happens (as when this fails).
+func uploadChunks(r io.Reader) (*chunkUpload, error) {
+	up := &chunkUpload{info: &chunkInfo{ID: randomID(), ChunkSize: valueChunkSize}}
+	for {
+		buf := make([]byte, valueChunkSize)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return up, err
+		}
+		if n == 0 {
+			return up, nil
+		}
+
+		if len(up.pending) == chunksPerWrite {
+			if err := up.flush(); err != nil {
+				return up, err
+			}
+		}
+		up.pending = append(up.pending, buf[:n])
+		up.info.Size += int64(n)
+		if n < len(buf) {
+			return up, nil
+		}
+	}
+}
+
+// chunkValue splits a value already in memory into an upload's chunks
+func chunkValue(value []byte) *chunkUpload {
+	up := &chunkUpload{info: &chunkInfo{ID: randomID(), Size: int64(len(value)), ChunkSize: valueChunkSize}}
+	for len(value) > 0 {
+		n := valueChunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+		up.pending = append(up.pending, value[:n])
+		value = value[n:]
+	}
+	return up
+}
+
+// addPending adds writing the pending chunks to wb
+func (up *chunkUpload) addPending(wb *levigo.WriteBatch) {
+	first := up.info.count() - int64(len(up.pending))
+	for i, chunk := range up.pending {
+		wb.Put(chunkKey(up.info.ID, first+int64(i)), chunk)
+	}
+}
+
+// flush writes the pending chunks, along with the upload's marker
+func (up *chunkUpload) flush() error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	wb.Put(uploadKey(up.info.ID), nil)
+	up.addPending(wb)
+	if err := db.Write(wo, wb); err != nil {
+		return err
+	}
+	up.pending, up.started = nil, true
+	return nil
+}
+
+// finish adds the rest of the upload to wb, the batch that also writes the
+// header pointing at its chunks
+func (up *chunkUpload) finish(wb *levigo.WriteBatch) {
+	up.addPending(wb)
+	if up.started {
+		wb.Delete(uploadKey(up.info.ID))
+	}
+}
+
+// discard removes what's been written of an upload that didn't make it
+func (up *chunkUpload) discard() {
+	if !up.started {
+		return
+	}
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	dropChunks(wb, up.info)
+	wb.Delete(uploadKey(up.info.ID))
+	db.Write(wo, wb)
+}
+
+// dropChunks adds deleting a chunked value's chunks to wb
+func dropChunks(wb *levigo.WriteBatch, info *chunkInfo) {
+	for i := int64(0); i < info.count(); i++ {
+		wb.Delete(chunkKey(info.ID, i))
+	}
+}
+
+// sweepUploads removes the chunks of uploads cut off by a crash (or the
+// server otherwise going away mid-upload). it runs as the db is opened,
+// before any upload can be going.
+func sweepUploads() error {
+	prefix := uploadKey("")
+	var ids []string
+
+	it := db.NewIterator(ro)
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		ids = append(ids, string(it.Key()[len(prefix):]))
+	}
+	err := it.GetError()
+	it.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		chunks := internalKey("chunk/" + id + "/")
+		_, err := eachChunk(context.Background(), chunks, prefixEnd(chunks), oneChunk, func(wb *levigo.WriteBatch, key, value []byte) {
+			wb.Delete(key)
+		})
+		if err == nil {
+			err = db.Delete(wo, uploadKey(id))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkReader reads a chunked value a chunk at a time
+type chunkReader struct {
+	ro   *levigo.ReadOptions
+	info *chunkInfo
+	pos  int64
+
+	// the chunk most recently read, and its index
+	chunk []byte
+	index int64
+}
+
+func newChunkReader(ro *levigo.ReadOptions, info *chunkInfo) *chunkReader {
+	return &chunkReader{ro: ro, info: info, index: -1}
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.pos >= cr.info.Size {
+		return 0, io.EOF
+	}
+
+	i := cr.pos / cr.info.ChunkSize
+	if i != cr.index {
+		chunk, err := db.Get(cr.ro, chunkKey(cr.info.ID, i))
+		if err != nil {
+			return 0, err
+		}
+		if chunk == nil {
+			return 0, errChunkMissing
+		}
+		cr.chunk, cr.index = chunk, i
+	}
+
+	n := copy(p, cr.chunk[cr.pos-i*cr.info.ChunkSize:])
+	cr.pos += int64(n)
+	return n, nil
+}
+
+func (cr *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += cr.pos
+	case io.SeekEnd:
+		offset += cr.info.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the value")
+	}
+	cr.pos = offset
+	return offset, nil
+}
+
+// loadValue reads a stored value's header and whole value, putting together
+// a chunked value's chunks and decompressing a compressed one. the header is
+// as it would be for the value stored in one piece, uncompressed.
+func loadValue(ro *levigo.ReadOptions, stored []byte) (*valueHeader, []byte, error) {
+	h, value := decodeValue(stored)
+	if h.Chunks != nil {
+		value = make([]byte, h.Chunks.Size)
+		if _, err := io.ReadFull(newChunkReader(ro, h.Chunks), value); err != nil {
+			return nil, nil, err
+		}
+		h.Chunks = nil
+	}
+
+	value, err := decompress(h, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.Encoding = ""
+	return h, value, nil
+}
@@ -0,0 +1,206 @@
+package libldbrest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// comparator is a key order. "bytewise" is leveldb's own default; the others
+// are implemented here and handed to leveldb through cgo.
+type comparator struct {
+	name    string
+	compare func(a, b []byte) int
+}
+
+var comparators = map[string]*comparator{
+	"bytewise":         {"bytewise", bytes.Compare},
+	"reverse-bytewise": {"reverse-bytewise", compareReverse},
+	"numeric-aware":    {"numeric-aware", compareNumeric},
+	"case-insensitive": {"case-insensitive", compareFolded},
+}
+
+// keyOrder is the comparator the database is opened with
+var keyOrder = comparators["bytewise"]
+
+// custom reports whether leveldb needs to be given the comparator
+func (c *comparator) custom() bool {
+	return c.name != "bytewise"
+}
+
+// SetComparator picks the key order by name (see the comparators map). It
+// must be set before OpenDB, and match the one the database was created with.
+func SetComparator(name string) error {
+	c, ok := comparators[name]
+	if !ok {
+		names := make([]string, 0, len(comparators))
+		for name := range comparators {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown comparator %q (choose from %s)", name, strings.Join(names, ", "))
+	}
+	keyOrder = c
+	return nil
+}
+
+// compareKeys orders stored keys the way the database does
+func compareKeys(a, b []byte) int {
+	if !keyOrder.custom() {
+		return bytes.Compare(a, b)
+	}
+	return keyOrder.order(a, b)
+}
+
+// order is the complete order leveldb is given for a custom comparator. it
+// only applies to client keys: the internal keyspace sorts after all of them
+// and bytewise within itself, as the bookkeeping there relies on, except that
+// keys in the same bucket are ordered by the comparator as well.
+func (c *comparator) order(a, b []byte) int {
+	ai, bi := isInternal(a), isInternal(b)
+	switch {
+	case ai && bi:
+		if n := sameBucket(a, b); n > 0 {
+			return c.compare(a[n:], b[n:])
+		}
+		return bytes.Compare(a, b)
+	case ai:
+		return 1
+	case bi:
+		return -1
+	}
+	return c.compare(a, b)
+}
+
+// sameBucket is the length of the bucket prefix a and b share, or 0 if they
+// aren't keys of the same bucket. it runs inside leveldb so it goes by the
+// shape of the keys, not the bucket definitions.
+func sameBucket(a, b []byte) int {
+	n := len(bucketKeysPrefix) + bucketIDLen + 1
+	if len(a) < n || len(b) < n || !bytes.HasPrefix(a, bucketKeysPrefix) || a[n-1] != '/' {
+		return 0
+	}
+	if !bytes.Equal(a[:n], b[:n]) {
+		return 0
+	}
+	return n
+}
+
+func compareReverse(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+// compareFolded ignores ASCII case, falling back to bytewise to break ties
+// so that keys differing only in case are still different keys
+func compareFolded(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lower(a[i]), lower(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// compareNumeric compares runs of ASCII digits by their value ("x9" before
+// "x10") and everything else bytewise. ties (as with "x01" and "x1") are
+// broken bytewise.
+func compareNumeric(a, b []byte) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				if a[i] < b[j] {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
+			continue
+		}
+
+		ni, nj := digitsEnd(a, i), digitsEnd(b, j)
+		da := bytes.TrimLeft(a[i:ni], "0")
+		db := bytes.TrimLeft(b[j:nj], "0")
+		if len(da) != len(db) {
+			if len(da) < len(db) {
+				return -1
+			}
+			return 1
+		}
+		if cmp := bytes.Compare(da, db); cmp != 0 {
+			return cmp
+		}
+		i, j = ni, nj
+	}
+	switch {
+	case len(a)-i < len(b)-j:
+		return -1
+	case len(a)-i > len(b)-j:
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func digitsEnd(b []byte, i int) int {
+	for i < len(b) && isDigit(b[i]) {
+		i++
+	}
+	return i
+}
+
+// the comparator a database was created with is recorded in this file in
+// its directory, since leveldb only notices a mismatched comparator by name
+// and ours must be told apart from a database that never had one
+const comparatorFile = "LDBREST_COMPARATOR"
+
+// checkComparator makes sure the database at path (if there is one) was
+// created with keyOrder. databases from before the marker are bytewise.
+func checkComparator(path string) error {
+	name := "bytewise"
+	b, err := ioutil.ReadFile(filepath.Join(path, comparatorFile))
+	switch {
+	case err == nil:
+		name = strings.TrimSpace(string(b))
+	case !os.IsNotExist(err):
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); os.IsNotExist(err) && name == "bytewise" {
+		// a new database, it'll be marked once it's created
+		return nil
+	}
+	if name != keyOrder.name {
+		return fmt.Errorf("%s uses the %s comparator, not %s", path, name, keyOrder.name)
+	}
+	return nil
+}
+
+// markComparator records keyOrder in the database at path
+func markComparator(path string) error {
+	return ioutil.WriteFile(filepath.Join(path, comparatorFile), []byte(keyOrder.name+"\n"), 0644)
+}
@@ -0,0 +1,58 @@
+package libldbrest
+
+// #cgo LDFLAGS: -lleveldb
+// #include <stdlib.h>
+// #include "leveldb/c.h"
+//
+// extern int ldbrestCompare(void*, char*, size_t, char*, size_t);
+//
+// static int ldbrest_compare(void* state, const char* a, size_t alen, const char* b, size_t blen) {
+// 	return ldbrestCompare(state, (char*)a, alen, (char*)b, blen);
+// }
+//
+// static const char* ldbrest_name(void* state) {
+// 	return state;
+// }
+//
+// static void ldbrest_destroy(void* state) {}
+//
+// static leveldb_comparator_t* ldbrest_comparator_create(char* name) {
+// 	return leveldb_comparator_create(name, ldbrest_destroy, ldbrest_compare, ldbrest_name);
+// }
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/jmhodges/levigo"
+)
+
+var (
+	// the leveldb side of each custom comparator, which lives as long as
+	// the process does
+	leveldbComparators = make(map[string]*C.leveldb_comparator_t)
+
+	// the comparator for each one's state (its name as a C string)
+	comparatorStates = make(map[uintptr]*comparator)
+)
+
+func init() {
+	for name, c := range comparators {
+		if !c.custom() {
+			continue
+		}
+		// leveldb checks the name against the one the database was created
+		// with, which gives a second line of defense behind the marker file
+		state := C.CString("ldbrest." + name)
+		leveldbComparators[name] = C.ldbrest_comparator_create(state)
+		comparatorStates[uintptr(unsafe.Pointer(state))] = c
+	}
+}
+
+// useComparator sets keyOrder on options for opening a database
+func useComparator(opts *levigo.Options) {
+	if keyOrder.custom() {
+		copts := (*C.leveldb_options_t)(unsafe.Pointer(opts.Opt))
+		C.leveldb_options_set_comparator(copts, leveldbComparators[keyOrder.name])
+	}
+}
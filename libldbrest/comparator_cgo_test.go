@@ -0,0 +1,202 @@
+package libldbrest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/levigo"
+)
+
+func TestComparatorDatabases(t *testing.T) {
+	defer func() { keyOrder = comparators["bytewise"] }()
+
+	keys := []string{"k", "k10", "k9", "k09", "K9", "kA", "ka", "kb", "k/x2", "k/x10"}
+
+	for name, c := range comparators {
+		if !c.custom() {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			keyOrder = c
+			dbpath := setup(t)
+			defer cleanup(dbpath)
+
+			app := newAppTester(t)
+			app.doReq("PUT", "http://domain/b/bkt", "")
+			for _, key := range keys {
+				app.put(key, strings.ToUpper(key))
+				app.doReq("PUT", "http://domain/b/bkt/key/"+key, key)
+			}
+			app.put("z", "Z")
+
+			want := append([]string(nil), keys...)
+			sort.Slice(want, func(i, j int) bool { return c.compare([]byte(want[i]), []byte(want[j])) < 0 })
+			wantAll := append([]string{"z"}, want...)
+			sort.Slice(wantAll, func(i, j int) bool { return c.compare([]byte(wantAll[i]), []byte(wantAll[j])) < 0 })
+
+			iter := func(url string) string {
+				rr := app.doReq("GET", "http://domain"+url, "")
+				assert(t, rr.Code == 200, "bad GET %s response: %d", url, rr.Code)
+				resp := &struct {
+					Data []string
+				}{}
+				if err := json.Unmarshal(rr.Body.Bytes(), resp); err != nil {
+					t.Fatal(err)
+				}
+				return strings.Join(resp.Data, ",")
+			}
+			reversed := func(keys []string) string {
+				var out []string
+				for i := len(keys) - 1; i >= 0; i-- {
+					out = append(out, keys[i])
+				}
+				return strings.Join(out, ",")
+			}
+
+			got := iter("/iterate?include_values=no")
+			assert(t, got == strings.Join(wantAll, ","), "wrong iteration order: %s", got)
+			got = iter("/iterate?include_values=no&forward=no")
+			assert(t, got == reversed(wantAll), "wrong reverse iteration order: %s", got)
+			got = iter(fmt.Sprintf("/iterate?include_values=no&start=%s&end=%s&include_end=yes", want[1], want[3]))
+			assert(t, got == strings.Join(want[1:4], ","), "wrong bounded iteration: %s", got)
+
+			got = iter("/b/bkt/iterate?include_values=no")
+			assert(t, got == strings.Join(want, ","), "wrong bucket iteration order: %s", got)
+			got = iter("/b/bkt/iterate?include_values=no&forward=no")
+			assert(t, got == reversed(want), "wrong reverse bucket iteration order: %s", got)
+			got = iter(fmt.Sprintf("/b/bkt/iterate?include_values=no&start=%s&max=2", want[2]))
+			assert(t, got == strings.Join(want[2:4], ","), "wrong bucket page: %s", got)
+
+			// a prefix snapshot picks the prefix's keys out wherever they sort
+			var wantSnap []string
+			for _, key := range want {
+				if strings.HasPrefix(key, "k") {
+					wantSnap = append(wantSnap, key)
+				}
+			}
+			dest := dbpath + "_snap"
+			defer os.RemoveAll(dest)
+			rr := app.doReq("POST", "http://domain/snapshot", fmt.Sprintf(`{"destination": %q, "prefix": "k"}`, dest))
+			assert(t, rr.Code == 204, "bad POST /snapshot response: %d", rr.Code)
+			opts := levigo.NewOptions()
+			defer opts.Close()
+			useComparator(opts)
+			snap, err := levigo.Open(dest, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer snap.Close()
+			it := snap.NewIterator(ro)
+			defer it.Close()
+			var snapped []string
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				snapped = append(snapped, string(it.Key()))
+			}
+			assert(t, strings.Join(snapped, ",") == strings.Join(wantSnap, ","), "wrong snapshotted keys: %v", snapped)
+		})
+	}
+}
+
+func TestCustomComparator(t *testing.T) {
+	keyOrder = comparators["reverse-bytewise"]
+	defer func() { keyOrder = comparators["bytewise"] }()
+
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		app.put(key, strings.ToUpper(key))
+	}
+	app.doReq("PUT", "http://domain/b/bkt", "")
+	for _, key := range []string{"x", "y", "z"} {
+		app.doReq("PUT", "http://domain/b/bkt/key/"+key, key)
+	}
+
+	iter := func(url string) string {
+		rr := app.doReq("GET", "http://domain"+url, "")
+		assert(t, rr.Code == 200, "bad GET %s response: %d", url, rr.Code)
+		return strings.TrimSpace(rr.Body.String())
+	}
+	for url, want := range map[string]string{
+		"/iterate?include_values=no":                     `{"more":false,"data":["d","c","b","a"]}`,
+		"/iterate?include_values=no&start=c&end=a":       `{"more":false,"data":["c","b"]}`,
+		"/iterate?include_values=no&start=c&max=1":       `{"more":false,"data":["c"]}`,
+		"/iterate?include_values=no&forward=no":          `{"more":false,"data":["a","b","c","d"]}`,
+		"/iterate?include_values=no&forward=no&start=b":  `{"more":false,"data":["b","c","d"]}`,
+		"/b/bkt/iterate?include_values=no":               `{"more":false,"data":["z","y","x"]}`,
+		"/b/bkt/iterate?include_values=no&forward=no":    `{"more":false,"data":["x","y","z"]}`,
+		"/b/bkt/iterate?include_values=no&start=y&end=x": `{"more":false,"data":["y"]}`,
+		"/b/bkt/iterate?include_values=no&start=y&max=1": `{"more":true,"data":["y"],"last":"y"}`,
+	} {
+		got := iter(url)
+		assert(t, got == want, "GET %s: %s", url, got)
+	}
+
+	// keys a token can't read are skipped without shortening the page
+	tokens = map[string]role{"t": roleRead}
+	acl = map[string][]aclRule{"token:t": {{aclRead, []byte("a")}, {aclRead, []byte("c")}, {aclRead, []byte("d")}}}
+	for url, want := range map[string]string{
+		"/iterate?include_values=no&max=2":                                `{"more":false,"data":["d","c"]}`,
+		"/iterate?include_values=no&start=c&include_start=no&max=1":       `{"more":false,"data":["a"]}`,
+		"/iterate?include_values=no&start=d&end=a&max=1":                  `{"more":true,"data":["d"],"last":"d"}`,
+		"/iterate?include_values=no&start=d&end=a&include_start=no&max=1": `{"more":true,"data":["c"],"last":"c"}`,
+		"/iterate?include_values=no&start=c&end=a&include_start=no&max=1": `{"more":false,"data":[]}`,
+	} {
+		req, err := http.NewRequest("GET", "http://domain"+url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer t")
+		rr := httptest.NewRecorder()
+		app.app.ServeHTTP(rr, req)
+		got := strings.TrimSpace(rr.Body.String())
+		assert(t, got == want, "GET %s as a restricted token: %s", url, got)
+	}
+	tokens, acl = nil, nil
+
+	rr := app.doReq("GET", "http://domain/b/bkt/stats", "")
+	assert(t, strings.Contains(rr.Body.String(), `"keys":3`), "wrong bucket stats: %s", rr.Body.String())
+
+	// index rebuilds find a prefix's keys wherever they sort
+	app.put("u/1", `{"n": 1}`)
+	app.put("u/2", `{"n": 2}`)
+	rr = app.doReq("PUT", "http://domain/index/n", `{"prefix": "u/", "path": "n"}`)
+	assert(t, rr.Code == 202, "bad PUT /index/n response: %d", rr.Code)
+	for i := 0; i < 100; i++ {
+		if st := rebuildState("n"); st != nil && st.State != "running" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := iter("/index/n?start=1&end=3")
+	assert(t, strings.Count(got, `"key"`) == 2, "wrong index lookup: %s", got)
+
+	// snapshots are copied in order, with the comparator
+	dest := dbpath + "_snap"
+	defer os.RemoveAll(dest)
+	rr = app.doReq("POST", "http://domain/snapshot", fmt.Sprintf(`{"destination": %q, "start": "c", "end": "a"}`, dest))
+	assert(t, rr.Code == 204, "bad POST /snapshot response: %d", rr.Code)
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	useComparator(opts)
+	snap, err := levigo.Open(dest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	it := snap.NewIterator(ro)
+	defer it.Close()
+	var keys []string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	assert(t, strings.Join(keys, ",") == "c,b", "wrong snapshotted keys: %v", keys)
+}
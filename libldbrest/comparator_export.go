@@ -0,0 +1,19 @@
+package libldbrest
+
+// #include <stddef.h>
+import "C"
+
+import "unsafe"
+
+// ldbrestCompare is called by leveldb (through comparator_cgo.go's
+// ldbrest_compare) to order keys. it's called for every comparison, so the
+// keys are looked at in place rather than copied.
+//
+//export ldbrestCompare
+func ldbrestCompare(state unsafe.Pointer, a *C.char, alen C.size_t, b *C.char, blen C.size_t) C.int {
+	c := comparatorStates[uintptr(state)]
+	return C.int(c.order(
+		unsafe.Slice((*byte)(unsafe.Pointer(a)), int(alen)),
+		unsafe.Slice((*byte)(unsafe.Pointer(b)), int(blen)),
+	))
+}
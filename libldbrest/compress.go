@@ -0,0 +1,117 @@
+package libldbrest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CompressRule compresses the values of keys starting with Prefix with
+// Encoding, "gzip" or "none" (to exempt keys under a longer prefix).
+type CompressRule struct {
+	Prefix, Encoding string
+}
+
+// compressRules, longest prefix first
+var compressRules []CompressRule
+
+// SetCompression sets which values are stored compressed. Where more than one
+// rule's prefix matches a key the longest wins. Values stored in chunks are
+// never compressed.
+func SetCompression(rules []CompressRule) error {
+	for _, rule := range rules {
+		if rule.Encoding != "gzip" && rule.Encoding != "none" {
+			return fmt.Errorf("unsupported encoding %q (must be \"gzip\" or \"none\")", rule.Encoding)
+		}
+	}
+
+	sorted := append([]CompressRule{}, rules...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+	compressRules = sorted
+	return nil
+}
+
+// compressValue compresses a value being stored under key if a rule says
+// to, recording the encoding in its header. values that don't get any
+// smaller are left alone.
+func compressValue(key []byte, h *valueHeader, value []byte) []byte {
+	for _, rule := range compressRules {
+		if !bytes.HasPrefix(key, []byte(rule.Prefix)) {
+			continue
+		}
+		if rule.Encoding == "none" {
+			return value
+		}
+
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write(value)
+		zw.Close()
+		if buf.Len() >= len(value) {
+			return value
+		}
+		h.Encoding = rule.Encoding
+		return buf.Bytes()
+	}
+	return value
+}
+
+// decompress undoes compressValue
+func decompress(h *valueHeader, value []byte) ([]byte, error) {
+	switch h.Encoding {
+	case "":
+		return value, nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(zr)
+	}
+	return nil, fmt.Errorf("value has unknown encoding %q", h.Encoding)
+}
+
+// acceptsEncoding reports whether the client's Accept-Encoding allows enc
+func acceptsEncoding(r *http.Request, enc string) bool {
+	// an explicit mention of enc overrides "*"
+	accepted := map[string]bool{}
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+
+			ok := true
+			for _, param := range params[1:] {
+				if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					ok = err == nil && q > 0
+				}
+			}
+			accepted[name] = ok
+		}
+	}
+
+	if ok, mentioned := accepted[enc]; mentioned {
+		return ok
+	}
+	return accepted["*"]
+}
+
+// compressedResponse returns where to write a response body, gzipping it if
+// the client accepts that. the returned func must be called when it's done.
+func compressedResponse(w http.ResponseWriter, r *http.Request) (io.Writer, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsEncoding(r, "gzip") {
+		return w, func() {}
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	zw := gzip.NewWriter(w)
+	return zw, func() { zw.Close() }
+}
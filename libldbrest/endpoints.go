@@ -2,11 +2,19 @@ package libldbrest
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jmhodges/levigo"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -26,56 +34,193 @@ func InitRouter(prefix string) *httprouter.Router {
 		PanicHandler:           handlePanics,
 	}
 
-	// retrieve single keys
-	router.GET(prefix+"/key/*name", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		b, err := db.Get(ro, []byte(p.ByName("name")[1:]))
+	// liveness and readiness, for orchestrators
+	// (neither gated nor authed: they must answer while the db is opening)
+	router.GET(prefix+"/healthz", healthz)
+	router.GET(prefix+"/readyz", readyz)
+
+	// retrieve single keys, or just their headers
+	router.GET(prefix+"/key/*name", endpoint("key", roleRead, getKey))
+	router.HEAD(prefix+"/key/*name", endpoint("key", roleRead, getKey))
+	router.GET(prefix+"/b/:bucket/key/*name", endpoint("key", roleRead, getKey))
+	router.HEAD(prefix+"/b/:bucket/key/*name", endpoint("key", roleRead, getKey))
+
+	// set single keys (value goes in the body)
+	putKey := endpoint("key", roleWrite, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		key, ok := routeKey(w, r, p)
+		if !ok || !checkKeyLength(w, key) || !checkKey(w, r, aclWrite, key) {
+			return
+		}
+
+		// read at most one byte past the limit, to tell that it's over
+		var body io.Reader = r.Body
+		if limits.MaxValueSize > 0 {
+			body = io.LimitReader(body, int64(limits.MaxValueSize)+1)
+		}
+
+		// values up to a chunk in size are stored whole,
+		// anything bigger is streamed into chunks
+		buf := &bytes.Buffer{}
+		if _, err := io.CopyN(buf, body, valueChunkSize+1); err != nil && err != io.EOF {
+			if isTooLarge(err) {
+				failBodyTooLarge(w)
+			} else {
+				failErr(w, err)
+			}
+			return
+		}
+
+		h := requestHeader(r)
+		size := int64(buf.Len())
+		value := buf.Bytes()
+		var up *chunkUpload
+		if size <= valueChunkSize {
+			if msg := valueSizeErr(value); msg != "" {
+				failTooLarge(w, msg)
+				return
+			}
+			value = compressValue(key, h, value)
+		} else {
+			var err error
+			if up, err = uploadChunks(io.MultiReader(buf, body)); err != nil {
+				up.discard()
+				if isTooLarge(err) {
+					failBodyTooLarge(w)
+				} else {
+					failErr(w, err)
+				}
+				return
+			}
+			if limits.MaxValueSize > 0 && up.info.Size > int64(limits.MaxValueSize) {
+				up.discard()
+				failTooLarge(w, fmt.Sprintf("value is over the %d byte limit", limits.MaxValueSize))
+				return
+			}
+			h.Chunks, size, value = up.info, up.info.Size, nil
+		}
+
+		stored := encodeValue(h, value)
+		err := writeOne(func(wr *writer) error {
+			if up != nil {
+				up.finish(wr.wb)
+			}
+			return wr.put(key, stored)
+		})
 		if err != nil {
+			if up != nil {
+				up.discard()
+			}
 			failErr(w, err)
-		} else if b == nil {
-			failCode(w, http.StatusNotFound)
 		} else {
-			w.Header().Set("Content-Type", "text/plain")
-			w.Write(b)
+			valueBytesWritten.add("", float64(size))
+			w.WriteHeader(http.StatusNoContent)
 		}
 	})
+	router.PUT(prefix+"/key/*name", putKey)
+	router.PUT(prefix+"/b/:bucket/key/*name", putKey)
 
-	// set single keys (value goes in the body)
-	router.PUT(prefix+"/key/*name", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		buf := &bytes.Buffer{}
-		if _, err := io.Copy(buf, r.Body); err != nil {
-			failErr(w, err)
+	// update a JSON value in place with a merge patch or JSON Patch
+	patchKey := endpoint("key", roleWrite, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		key, ok := routeKey(w, r, p)
+		if !ok {
 			return
 		}
+		// the response shows the value, so patching needs read access too
+		if !checkKeyLength(w, key) || !checkKey(w, r, aclWrite, key) || !checkKey(w, r, aclRead, key) {
+			return
+		}
+
+		var format string
+		switch ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct {
+		case mergePatchType, jsonPatchType:
+			format = ct
+		}
+		upsert := r.URL.Query().Get("upsert") == "yes"
 
-		err := db.Put(wo, []byte(p.ByName("name")[1:]), buf.Bytes())
+		patch, err := ioutil.ReadAll(r.Body)
 		if err != nil {
+			if isTooLarge(err) {
+				failBodyTooLarge(w)
+			} else {
+				failErr(w, err)
+			}
+			return
+		}
+
+		var doc []byte
+		err = writeOne(func(wr *writer) error {
+			stored, err := wr.current(key)
+			if err != nil {
+				return err
+			}
+			if stored == nil && !upsert {
+				return errNoKey
+			}
+			h, value, err := loadValue(ro, stored)
+			if err != nil {
+				return err
+			}
+			if doc, err = applyPatch(value, patch, format); err != nil {
+				return err
+			}
+			if msg := valueSizeErr(doc); msg != "" {
+				return &apiError{Code: codeTooLarge, Message: msg, status: http.StatusRequestEntityTooLarge}
+			}
+			return wr.putValue(key, h, doc)
+		})
+
+		if ae, ok := err.(*apiError); ok {
+			fail(w, ae.statusOr(http.StatusBadRequest), ae)
+		} else if err != nil {
 			failErr(w, err)
 		} else {
-			w.WriteHeader(http.StatusNoContent)
+			valueBytesWritten.add("", float64(len(doc)))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(doc)
 		}
 	})
+	router.PATCH(prefix+"/key/*name", patchKey)
+	router.PATCH(prefix+"/b/:bucket/key/*name", patchKey)
 
 	// delete a key by name
-	router.DELETE(prefix+"/key/*name", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		err := db.Delete(wo, []byte(p.ByName("name")[1:]))
+	deleteKey := endpoint("key", roleWrite, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		key, ok := routeKey(w, r, p)
+		if !ok || !checkKeyLength(w, key) || !checkKey(w, r, aclWrite, key) {
+			return
+		}
+
+		err := writeOne(func(wr *writer) error { return wr.del(key) })
 		if err != nil {
 			failErr(w, err)
 		} else {
 			w.WriteHeader(http.StatusNoContent)
 		}
 	})
+	router.DELETE(prefix+"/key/*name", deleteKey)
+	router.DELETE(prefix+"/b/:bucket/key/*name", deleteKey)
 
 	// retrieve a given set of keys
 	// (must be a POST to accept a request body, but we aren't changing server-side data)
-	router.POST(prefix+"/keys", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	router.POST(prefix+"/keys", endpoint("keys", roleRead, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		req := &struct{ Keys []string }{}
 
 		err := json.NewDecoder(r.Body).Decode(req)
 		if err != nil {
-			failErr(w, err)
+			failDecode(w, err)
 			return
 		}
 
+		noteTarget(r, "%d keys", len(req.Keys))
+		if limits.MaxKeys > 0 && len(req.Keys) > limits.MaxKeys {
+			failLimit(w, fmt.Sprintf("%d keys requested, over the limit of %d", len(req.Keys), limits.MaxKeys))
+			return
+		}
+		for _, key := range req.Keys {
+			if !checkKey(w, r, aclRead, []byte(key)) {
+				return
+			}
+		}
+
 		results := make(map[string]string, len(req.Keys))
 		for _, key := range req.Keys {
 			val, err := db.Get(ro, []byte(key))
@@ -83,18 +228,35 @@ func InitRouter(prefix string) *httprouter.Router {
 				failErr(w, err)
 				return
 			}
+			if _, val, err = loadValue(ro, val); err != nil {
+				failErr(w, err)
+				return
+			}
 			results[key] = string(val)
+			valueBytesRead.add("", float64(len(val)))
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(results)
-	})
+		out, done := compressedResponse(w, r)
+		defer done()
+		json.NewEncoder(out).Encode(results)
+	}))
 
 	// fetch a contiguous range of keys and their values
-	router.GET(prefix+"/iterate", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	iterateKeys := endpoint("iterate", roleRead, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		q := r.URL.Query()
 		start := q.Get("start")
 		end := q.Get("end")
+		noteTarget(r, "%s..%s", start, end)
+
+		var bucket *bucketDef
+		if name := p.ByName("bucket"); name != "" {
+			noteTarget(r, "%s:%s..%s", name, start, end)
+			if bucket = getBucket(name); bucket == nil {
+				fail(w, http.StatusNotFound, errNoBucket)
+				return
+			}
+		}
 
 		var (
 			max int
@@ -104,7 +266,7 @@ func InitRouter(prefix string) *httprouter.Router {
 		if maxs == "" {
 			max = ABSMAX
 		} else if max, err = strconv.Atoi(maxs); err != nil {
-			failErr(w, err)
+			failBadRequest(w, codeBadParam, "max must be an integer")
 			return
 		}
 		if max > ABSMAX {
@@ -118,71 +280,528 @@ func InitRouter(prefix string) *httprouter.Router {
 		include_end := q.Get("include_end") == "yes"
 		backwards := q.Get("forward") == "no"
 		skip_values := q.Get("include_values") == "no"
+		include_meta := q.Get("include_meta") == "yes"
+
+		// tuple keys are given as JSON, and keys that are tuples come back
+		// decoded (any others stay strings)
+		startKey, endKey := []byte(start), []byte(end)
+		tuples := tupleKeys(r)
+		if tuples {
+			for _, bound := range []*[]byte{&startKey, &endKey} {
+				if len(*bound) == 0 {
+					continue
+				}
+				if *bound, err = parseTupleKey(*bound); err != nil {
+					failBadRequest(w, codeBadKey, err.Error())
+					return
+				}
+			}
+		}
+		showKey := func(key []byte) interface{} {
+			if tuples {
+				if tuple, err := decodeTuple(key); err == nil {
+					return tuple
+				}
+			}
+			return string(key)
+		}
 
 		type keyval struct {
-			Key   string `json:"key"`
-			Value string `json:"value"`
+			Key   interface{} `json:"key"`
+			Value string      `json:"value"`
+		}
+		type keymeta struct {
+			Key         interface{}       `json:"key"`
+			Value       *string           `json:"value,omitempty"`
+			ContentType string            `json:"content_type,omitempty"`
+			Meta        map[string]string `json:"meta,omitempty"`
 		}
 		type wrapper struct {
 			More bool          `json:"more"`
-			Data []interface{} `json:"data"` // either keyvals or just string keys
+			Data []interface{} `json:"data"` // keyvals, keymetas or just keys
+
+			// where to pick up from (with include_start=no) when there's more
+			Last interface{} `json:"last,omitempty"`
 		}
 
 		var (
 			data = make([]interface{}, 0)
 			more bool
+			last []byte
 		)
 
-		var once func([]byte, []byte) error
-		if skip_values {
-			once = func(key, value []byte) error {
-				data = append(data, string(key))
+		var once func([]byte, *valueHeader, []byte) error
+		if include_meta {
+			once = func(key []byte, h *valueHeader, value []byte) error {
+				km := &keymeta{Key: showKey(key), ContentType: h.ContentType, Meta: h.Meta}
+				if !skip_values {
+					s := string(value)
+					km.Value = &s
+				}
+				data = append(data, km)
+				return nil
+			}
+		} else if skip_values {
+			once = func(key []byte, h *valueHeader, value []byte) error {
+				data = append(data, showKey(key))
 				return nil
 			}
 		} else {
-			once = func(key, value []byte) error {
-				data = append(data, &keyval{string(key), string(value)})
+			once = func(key []byte, h *valueHeader, value []byte) error {
+				data = append(data, &keyval{showKey(key), string(value)})
 				return nil
 			}
 		}
 
-		if end == "" {
-			err = iterateN([]byte(start), max, !ignore_start, backwards, once)
-			more = false
-		} else {
-			more, err = iterateUntil([]byte(start), []byte(end), max, !ignore_start, include_end, backwards, once)
+		// with a custom comparator the keys the client may read aren't in
+		// ranges to confine the iteration to, so they're picked out one by
+		// one instead, with the rest skipped and not counted towards max
+		filtered := keyOrder.custom()
+
+		// give up if the client goes away or the server is shutting down,
+		// and split up stored values (or put chunked ones back together)
+		each := func(key, stored []byte) error {
+			if err := r.Context().Err(); err != nil {
+				return err
+			}
+			if filtered && !keyAllowed(r, aclRead, key) {
+				return errSkipped
+			}
+			iterateItems.add("", 1)
+
+			h, value := decodeValue(stored)
+			if !skip_values {
+				var err error
+				if h, value, err = loadValue(ro, stored); err != nil {
+					return err
+				}
+				valueBytesRead.add("", float64(len(value)))
+			}
+			if bucket != nil {
+				key = key[len(bucket.prefix()):]
+			}
+			last = key
+			return once(key, h, value)
+		}
+
+		// confine the iteration to the bucket (if it's in one), and go
+		// through the ranges of keys the client may read one by one
+		bounds := &iterBounds{startKey, endKey, !ignore_start, include_end, backwards}
+		if bucket != nil {
+			bounds.inBucket(bucket)
 		}
+		parts := []*iterBounds{bounds}
+		if !filtered {
+			parts = bounds.split(allowedRanges(r, aclRead, bucket))
+		}
+		more, err = iterateParts(parts, max, each)
 
 		if err != nil {
 			failErr(w, err)
 			return
 		}
+		resp := &wrapper{More: more, Data: data}
+		if more && last != nil {
+			resp.Last = showKey(last)
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(&wrapper{more, data})
+		out, done := compressedResponse(w, r)
+		defer done()
+		json.NewEncoder(out).Encode(resp)
 	})
+	router.GET(prefix+"/iterate", iterateKeys)
+	router.GET(prefix+"/b/:bucket/iterate", iterateKeys)
 
 	// atomically write a batch of updates
-	router.POST(prefix+"/batch", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	router.POST(prefix+"/batch", endpoint("batch", roleWrite, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		req := &struct{ Ops oplist }{}
 
-		err := json.NewDecoder(r.Body).Decode(req)
-		if err != nil {
-			failErr(w, err)
+		var err error
+		if tupleKeys(r) {
+			req.Ops, err = tupleOps(r.Body)
+		} else {
+			err = json.NewDecoder(r.Body).Decode(req)
+		}
+		if ae, ok := err.(*apiError); ok {
+			fail(w, http.StatusBadRequest, ae)
+			return
+		} else if err != nil {
+			failDecode(w, err)
+			return
+		}
+
+		noteTarget(r, "%d ops", len(req.Ops))
+		if limits.MaxBatchOps > 0 && len(req.Ops) > limits.MaxBatchOps {
+			failLimit(w, fmt.Sprintf("%d ops in the batch, over the limit of %d", len(req.Ops), limits.MaxBatchOps))
 			return
 		}
+		for _, op := range req.Ops {
+			if op == nil {
+				continue // applyBatch reports it
+			}
+			if !checkKey(w, r, aclWrite, []byte(op.Key)) {
+				return
+			}
+			// a patch's "test" ops can reveal the value
+			if op.Op == "patch" && !checkKey(w, r, aclRead, []byte(op.Key)) {
+				return
+			}
+		}
 
 		err = applyBatch(req.Ops)
-		if err == errBadBatch {
-			failCode(w, http.StatusBadRequest)
+		if ae, ok := err.(*apiError); ok {
+			fail(w, ae.statusOr(http.StatusBadRequest), ae)
 		} else if err != nil {
 			failErr(w, err)
+		} else {
+			batchOps.observe("", float64(len(req.Ops)))
+			for _, op := range req.Ops {
+				valueBytesWritten.add("", float64(len(op.Value)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	// look up keys by the values of an index
+	router.GET(prefix+"/index/:name", endpoint("index", roleRead, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		def := getIndex(p.ByName("name"))
+		if def == nil {
+			failCode(w, http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		query := &indexQuery{
+			def:           def,
+			max:           ABSMAX,
+			includeValues: q.Get("include_values") != "no",
+			filter:        func(key []byte) bool { return keyAllowed(r, aclRead, key) },
+		}
+
+		if maxs := q.Get("max"); maxs != "" {
+			max, err := strconv.Atoi(maxs)
+			if err != nil {
+				failBadRequest(w, codeBadParam, "max must be an integer")
+				return
+			}
+			if max < ABSMAX {
+				query.max = max
+			}
+		}
+
+		// "value" is an exact match, otherwise "start" and "end" bound a
+		// range (including "start" but not "end" by default, as in /iterate)
+		var ok bool
+		if value, exact := q["value"]; exact {
+			noteTarget(r, "%s=%s", def.Name, value[0])
+			if query.lo, ok = parseIndexValue(value[0]); !ok {
+				failBadRequest(w, codeBadParam, "value must be a scalar")
+				return
+			}
+			query.hi = prefixEnd(query.lo)
+		} else {
+			noteTarget(r, "%s=%s..%s", def.Name, q.Get("start"), q.Get("end"))
+			if start, ranged := q["start"]; ranged {
+				if query.lo, ok = parseIndexValue(start[0]); !ok {
+					failBadRequest(w, codeBadParam, "start must be a scalar")
+					return
+				}
+				if q.Get("include_start") == "no" {
+					query.lo = prefixEnd(query.lo)
+				}
+			}
+			if end, ranged := q["end"]; ranged {
+				if query.hi, ok = parseIndexValue(end[0]); !ok {
+					failBadRequest(w, codeBadParam, "end must be a scalar")
+					return
+				}
+				if q.Get("include_end") == "yes" {
+					query.hi = prefixEnd(query.hi)
+				}
+			}
+		}
+
+		// "after" continues from the "next" of a previous response
+		if after := q.Get("after"); after != "" {
+			cursor, err := hex.DecodeString(after)
+			if err != nil {
+				failBadRequest(w, codeBadParam, "after must be a cursor from a previous response")
+				return
+			}
+			cursor = append(cursor, 0)
+			if bytes.Compare(cursor, query.lo) > 0 {
+				query.lo = cursor
+			}
+		}
+
+		hits, more, next, err := query.run(r.Context())
+		if err != nil {
+			failErr(w, err)
+			return
+		}
+		iterateItems.add("", float64(len(hits)))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&struct {
+			More bool        `json:"more"`
+			Next string      `json:"next,omitempty"`
+			Data []*indexHit `json:"data"`
+		}{more, next, hits})
+	}))
+
+	// declare (or redefine) an index and build it from the existing data
+	router.PUT(prefix+"/index/:name", endpoint("indexes", roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		def := &indexDef{}
+		if err := json.NewDecoder(r.Body).Decode(def); err != nil {
+			failDecode(w, err)
+			return
+		}
+		def.Name = p.ByName("name")
+
+		noteTarget(r, "%s", def.Name)
+		if !validIndexName.MatchString(def.Name) {
+			failBadRequest(w, codeBadParam, "index names may only contain letters, digits, '_', '.' and '-'")
+			return
+		}
+		if def.Path == "" {
+			failBadRequest(w, codeBadJSON, `"path" is required`)
+			return
+		}
+		if isInternal([]byte(def.Prefix)) {
+			// bucket keys included, which entryFor would never index
+			failBadRequest(w, codeBadJSON, `"prefix" can't be in ldbrest's own keyspace, buckets can't be indexed`)
+			return
+		}
+
+		if err := createIndex(def); err != nil {
+			failErr(w, err)
+			return
+		}
+		startRebuild(def)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(&indexInfo{def, rebuildState(def.Name)})
+	}))
+
+	// drop an index and its entries
+	router.DELETE(prefix+"/index/:name", endpoint("indexes", roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("name")
+		noteTarget(r, "%s", name)
+		if getIndex(name) == nil {
+			failCode(w, http.StatusNotFound)
+		} else if err := dropIndex(r.Context(), name); err != nil {
+			failErr(w, err)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	// regenerate an index's entries from scratch
+	router.POST(prefix+"/index/:name/rebuild", endpoint("indexes", roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		def := getIndex(p.ByName("name"))
+		noteTarget(r, "%s", p.ByName("name"))
+		if def == nil {
+			failCode(w, http.StatusNotFound)
+			return
+		}
+		startRebuild(def)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(&indexInfo{def, rebuildState(def.Name)})
+	}))
+
+	// the declared indexes (over keys the client may read some of) and how
+	// their rebuilds are going
+	router.GET(prefix+"/indexes", endpoint("indexes", roleRead, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		infos := make([]*indexInfo, 0)
+		for _, def := range listIndexes() {
+			if !prefixAllowed(r, aclRead, []byte(def.Prefix)) {
+				continue
+			}
+			infos = append(infos, &indexInfo{def, rebuildState(def.Name)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}))
+
+	// create a bucket, a keyspace of its own under /b/<bucket>/
+	router.PUT(prefix+"/b/:bucket", endpoint("buckets", roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("bucket")
+		noteTarget(r, "%s", name)
+		if !validBucketName.MatchString(name) {
+			failBadRequest(w, codeBadParam, "bucket names may only contain letters, digits, '_', '.' and '-'")
+			return
+		}
+
+		def, created, err := createBucket(name)
+		if err != nil {
+			failErr(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(def)
+	}))
+
+	// drop a bucket and everything in it
+	router.DELETE(prefix+"/b/:bucket", endpoint("buckets", roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("bucket")
+		noteTarget(r, "%s", name)
+		if def := getBucket(name); def == nil {
+			fail(w, http.StatusNotFound, errNoBucket)
+		} else if err := dropBucket(r.Context(), def); err != nil {
+			failErr(w, err)
 		} else {
 			w.WriteHeader(http.StatusNoContent)
 		}
+	}))
+
+	// count a bucket's keys and their size
+	router.GET(prefix+"/b/:bucket/stats", endpoint("bucketstats", roleRead, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		name := p.ByName("bucket")
+		noteTarget(r, "%s", name)
+		if !checkBucket(w, r, aclRead, name) {
+			return
+		}
+		def := getBucket(name)
+		if def == nil {
+			fail(w, http.StatusNotFound, errNoBucket)
+			return
+		}
+
+		stats, err := statBucket(r.Context(), def)
+		if err != nil {
+			failErr(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}))
+
+	// the buckets there are (that the client may read from)
+	router.GET(prefix+"/buckets", endpoint("buckets", roleRead, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		defs := make([]*bucketDef, 0)
+		for _, def := range listBuckets() {
+			if bucketAllowed(r, aclRead, def.Name) {
+				defs = append(defs, def)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(defs)
+	}))
+
+	// open a transaction: reads through it come from a snapshot taken now
+	// (or its own writes), and its writes are buffered until it's committed
+	router.POST(prefix+"/txn", endpoint("txn", roleWrite, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		t := beginTxn(clientID(r))
+		if t == nil {
+			failRateLimited(w, time.Second, fmt.Sprintf("there are already %d transactions open", maxTxns))
+			return
+		}
+		noteTarget(r, "%s", t.id)
+
+		w.Header().Set("Location", prefix+"/txn/"+t.id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			ID      string  `json:"id"`
+			Timeout float64 `json:"timeout"`
+		}{t.id, txnTimeout.Seconds()})
+	}))
+
+	// read a key in a transaction
+	txnGet := txnEndpoint(roleRead, func(w http.ResponseWriter, r *http.Request, key []byte, t *txn) {
+		if !checkKey(w, r, aclRead, key) {
+			return
+		}
+
+		h, value, err := t.get(key)
+		if err != nil {
+			failErr(w, err)
+			return
+		} else if h == nil {
+			failCode(w, http.StatusNotFound)
+			return
+		}
+
+		h.writeHeader(w)
+		valueBytesRead.add("", float64(len(value)))
+		http.ServeContent(w, r, "", h.modTime(), bytes.NewReader(value))
+	})
+	router.GET(prefix+"/txn/:id/key/*name", txnGet)
+	router.GET(prefix+"/txn/:id/b/:bucket/key/*name", txnGet)
+
+	// set a key in a transaction
+	txnPut := txnEndpoint(roleWrite, func(w http.ResponseWriter, r *http.Request, key []byte, t *txn) {
+		if !checkKeyLength(w, key) || !checkKey(w, r, aclWrite, key) || !checkTxnSize(w, t, key) {
+			return
+		}
+
+		// read at most one byte past the limit, to tell that it's over
+		var body io.Reader = r.Body
+		if limits.MaxValueSize > 0 {
+			body = io.LimitReader(body, int64(limits.MaxValueSize)+1)
+		}
+		value, err := ioutil.ReadAll(body)
+		if err != nil {
+			if isTooLarge(err) {
+				failBodyTooLarge(w)
+			} else {
+				failErr(w, err)
+			}
+			return
+		}
+		if msg := valueSizeErr(value); msg != "" {
+			failTooLarge(w, msg)
+			return
+		}
+
+		t.put(key, requestHeader(r), value)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.PUT(prefix+"/txn/:id/key/*name", txnPut)
+	router.PUT(prefix+"/txn/:id/b/:bucket/key/*name", txnPut)
+
+	// delete a key in a transaction
+	txnDelete := txnEndpoint(roleWrite, func(w http.ResponseWriter, r *http.Request, key []byte, t *txn) {
+		if !checkKeyLength(w, key) || !checkKey(w, r, aclWrite, key) || !checkTxnSize(w, t, key) {
+			return
+		}
+
+		t.put(key, nil, nil)
+		w.WriteHeader(http.StatusNoContent)
 	})
+	router.DELETE(prefix+"/txn/:id/key/*name", txnDelete)
+	router.DELETE(prefix+"/txn/:id/b/:bucket/key/*name", txnDelete)
+
+	// apply a transaction's writes, if nothing it read has changed since
+	// its snapshot (either way, that's the end of the transaction)
+	router.POST(prefix+"/txn/:id/commit", txnEndpoint(roleWrite, func(w http.ResponseWriter, r *http.Request, key []byte, t *txn) {
+		err := t.commit()
+		t.end()
+
+		if ae, ok := err.(*apiError); ok {
+			fail(w, ae.statusOr(http.StatusBadRequest), ae)
+		} else if err != nil {
+			failErr(w, err)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	// abandon a transaction
+	router.DELETE(prefix+"/txn/:id", txnEndpoint(roleWrite, func(w http.ResponseWriter, r *http.Request, key []byte, t *txn) {
+		t.end()
+		w.WriteHeader(http.StatusNoContent)
+	}))
 
 	// get a leveldb property
-	router.GET(prefix+"/property/:name", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	router.GET(prefix+"/property/:name", endpoint("property", roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		prop := db.PropertyValue(p.ByName("name"))
 		if prop == "" {
 			failCode(w, http.StatusNotFound)
@@ -190,25 +809,198 @@ func InitRouter(prefix string) *httprouter.Router {
 			w.Header().Set("Content-Type", "text/plain")
 			w.Write([]byte(prop))
 		}
-	})
+	}))
+
+	// copy the db (or a range of it) via a point-in-time snapshot
+	router.POST(prefix+"/snapshot", endpoint("snapshot", roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		req := &snapSpec{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			failDecode(w, err)
+			return
+		}
+
+		noteTarget(r, "%s", req.Destination)
+		if req.Destination == "" {
+			failBadRequest(w, codeBadJSON, `"destination" is required`)
+			return
+		}
+		if err := req.check(); err != nil {
+			failBadRequest(w, codeBadJSON, err.Error())
+			return
+		}
+		if _, err := os.Stat(req.Destination); err == nil {
+			fail(w, http.StatusConflict, &apiError{Code: codeExists, Message: req.Destination + " already exists"})
+			return
+		}
+
+		start := time.Now()
+		if err := makeSnap(r.Context(), req); err != nil {
+			failErr(w, err)
+		} else {
+			snapshotSeconds.observe("", time.Since(start).Seconds())
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
 
-	// copy the whole db via a point-in-time snapshot
-	router.POST(prefix+"/snapshot", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// swap the served db for a snapshot (or back again)
+	// (not gated: it pauses the gate itself while it swaps)
+	router.POST(prefix+"/restore", instrumented("restore", authed(roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		req := &struct {
-			Destination string
+			Source string
+			Undo   bool
 		}{}
 		err := json.NewDecoder(r.Body).Decode(req)
 		if err != nil {
-			failErr(w, err)
+			failDecode(w, err)
 			return
 		}
 
-		if err := makeSnap(req.Destination); err != nil {
+		noteTarget(r, "%s", req.Source)
+		if req.Undo {
+			err = undoRestore()
+		} else {
+			err = restoreSnap(req.Source)
+		}
+
+		if err == errNoPrevious {
+			fail(w, http.StatusNotFound, &apiError{Code: statusCodes[http.StatusNotFound], Message: err.Error()})
+		} else if ae, ok := err.(*apiError); ok {
+			fail(w, http.StatusBadRequest, ae)
+		} else if err != nil {
 			failErr(w, err)
 		} else {
 			w.WriteHeader(http.StatusNoContent)
 		}
-	})
+	})))
+
+	// the request size limits in effect
+	router.GET(prefix+"/limits", instrumented("limits", authed(roleAdmin, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&limits)
+	})))
+
+	// metrics in prometheus' text format
+	router.GET(prefix+"/metrics", authed(roleRead, serveMetrics))
 
 	return router
 }
+
+// getKey serves a value, answering conditional requests
+// (If-None-Match, If-Modified-Since) with 304s
+func getKey(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	key, ok := routeKey(w, r, p)
+	if !ok || !checkKey(w, r, aclRead, key) {
+		return
+	}
+
+	b, err := db.Get(ro, key)
+	if err != nil {
+		failErr(w, err)
+		return
+	} else if b == nil {
+		failCode(w, http.StatusNotFound)
+		return
+	}
+	h, value := decodeValue(b)
+
+	var content io.ReadSeeker = bytes.NewReader(value)
+	size := int64(len(value))
+	if h.Chunks != nil {
+		// read the chunks from a snapshot, so that they can't be
+		// deleted by an overwrite while they're being sent
+		ss := db.NewSnapshot()
+		defer db.ReleaseSnapshot(ss)
+		sro := levigo.NewReadOptions()
+		defer sro.Close()
+		sro.SetSnapshot(ss)
+		sro.SetFillCache(false)
+
+		if b, err = db.Get(sro, key); err != nil {
+			failErr(w, err)
+			return
+		} else if b == nil {
+			failCode(w, http.StatusNotFound)
+			return
+		}
+		if h, value = decodeValue(b); h.Chunks != nil {
+			content, size = newChunkReader(sro, h.Chunks), h.Chunks.Size
+		} else {
+			content, size = bytes.NewReader(value), int64(len(value))
+		}
+	}
+
+	// compressed values go out as they are to clients that accept the
+	// encoding (with an ETag of their own), and decompressed to the rest
+	etag := valueETag(b)
+	if h.Encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(r, h.Encoding) {
+			w.Header().Set("Content-Encoding", h.Encoding)
+			etag = strings.TrimSuffix(etag, `"`) + "-" + h.Encoding + `"`
+		} else if value, err = decompress(h, value); err != nil {
+			failErr(w, err)
+			return
+		} else {
+			content, size = bytes.NewReader(value), int64(len(value))
+		}
+	}
+
+	h.writeHeader(w)
+	w.Header().Set("ETag", etag)
+
+	if r.Method == "GET" {
+		valueBytesRead.add("", float64(size))
+	}
+	http.ServeContent(w, r, "", h.modTime(), content)
+}
+
+// txnHandle is a handler for requests in a transaction. key is nil for
+// requests not about a key.
+type txnHandle func(w http.ResponseWriter, r *http.Request, key []byte, t *txn)
+
+// txnEndpoint is endpoint for requests in a transaction, which it finds (and
+// holds locked) for the handler, 404ing if the client has no such open txn
+func txnEndpoint(need role, h txnHandle) httprouter.Handle {
+	return endpoint("txn", need, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var key []byte
+		if name := p.ByName("name"); name != "" {
+			// a key like those of the other key routes, in a bucket or a tuple
+			var ok bool
+			if key, ok = routeKey(w, r, p); !ok {
+				return
+			}
+			if bucket := p.ByName("bucket"); bucket != "" {
+				noteTarget(r, "%s %s:%s", p.ByName("id"), bucket, name[1:])
+			} else {
+				noteTarget(r, "%s %s", p.ByName("id"), name[1:])
+			}
+		} else {
+			noteTarget(r, "%s", p.ByName("id"))
+		}
+
+		t := findTxn(p.ByName("id"), clientID(r))
+		if t == nil {
+			fail(w, http.StatusNotFound, &apiError{Code: codeNoTxn, Message: "no such transaction (it may have expired)"})
+			return
+		}
+		defer t.Unlock()
+		h(w, r, key, t)
+	})
+}
+
+// checkTxnSize 400s (and returns false) if writing key would put
+// more writes in the transaction than fit in a /batch
+func checkTxnSize(w http.ResponseWriter, t *txn, key []byte) bool {
+	if _, ok := t.writes[string(key)]; ok || limits.MaxBatchOps <= 0 || len(t.order) < limits.MaxBatchOps {
+		return true
+	}
+	failLimit(w, fmt.Sprintf("transaction is already writing %d keys, the limit", limits.MaxBatchOps))
+	return false
+}
+
+// endpoint wraps a handler with the checks every endpoint goes through,
+// and counts it in the metrics (and rate limits) under route
+func endpoint(route string, need role, h httprouter.Handle) httprouter.Handle {
+	return instrumented(route, authed(need, limited(route, gated(bounded(h)))))
+}
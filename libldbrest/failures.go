@@ -1,21 +1,122 @@
 package libldbrest
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+
+	"github.com/jmhodges/levigo"
+)
+
+// error codes for the "code" of error responses
+const (
+	codeBadJSON     = "bad_json"     // request body isn't the expected JSON
+	codeBadParam    = "bad_param"    // query string parameter is invalid
+	codeBadKey      = "bad_key"      // a tuple key isn't a valid tuple
+	codeBadBatchOp  = "bad_batch_op" // an op in a /batch is invalid
+	codeBadSnapshot = "bad_snapshot" // /restore source isn't a usable db
+	codeExists      = "exists"       // /snapshot destination already exists
+	codeBadPatch    = "bad_patch"    // PATCH body (or /batch patch) isn't a valid patch
+	codeNotJSON     = "not_json"     // the value being patched isn't JSON
+	codePatchFailed = "patch_failed" // a JSON Patch doesn't apply to the value
+	codeRateLimited = "rate_limited" // too many requests, try again later
+	codeNoTxn       = "no_txn"       // the transaction doesn't exist (or has expired)
+	codeTxnConflict = "txn_conflict" // a key the transaction read has changed since
+	codeNoBucket    = "no_bucket"    // the bucket doesn't exist
+	codeDBError     = "db_error"     // leveldb itself failed
+	codeInternal    = "internal"     // anything else that went wrong server-side
 )
 
+// statusCodes are the error codes for responses with no more specific one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:         "bad_request",
+	http.StatusUnauthorized:       "unauthorized",
+	http.StatusForbidden:          "forbidden",
+	http.StatusNotFound:           "not_found",
+	http.StatusConflict:           "conflict",
+	http.StatusServiceUnavailable: "unavailable",
+}
+
+// apiError is the body of every error response, wrapped as {"error": ...}
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// for errors in a /batch, the (0-based) index of the failing op
+	OpIndex *int `json:"op_index,omitempty"`
+
+	// the response status, for errors that don't leave it to the endpoint
+	status int
+}
+
+func (ae *apiError) Error() string {
+	return ae.Message
+}
+
+// statusOr is the error's own response status, or def if it hasn't one
+func (ae *apiError) statusOr(def int) int {
+	if ae.status != 0 {
+		return ae.status
+	}
+	return def
+}
+
+// fail sends an error response
+func fail(w http.ResponseWriter, status int, ae *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error *apiError `json:"error"`
+	}{ae})
+}
+
 func handlePanics(w http.ResponseWriter, r *http.Request, err interface{}) {
 	log.Printf("PANIC in handler: %v", err)
-	w.WriteHeader(http.StatusInternalServerError)
+	fail(w, http.StatusInternalServerError, &apiError{Code: codeInternal, Message: fmt.Sprint(err)})
 }
 
+// failErr 500s for a server-side error, distinguishing leveldb's own
 func failErr(w http.ResponseWriter, err error) {
+	if ae, ok := err.(*apiError); ok {
+		fail(w, ae.statusOr(http.StatusInternalServerError), ae)
+		return
+	}
 	log.Print(err)
-	w.WriteHeader(http.StatusInternalServerError)
+
+	code := codeInternal
+	if _, ok := err.(levigo.DatabaseError); ok {
+		code = codeDBError
+	}
+	fail(w, http.StatusInternalServerError, &apiError{Code: code, Message: err.Error()})
 }
 
 func failCode(w http.ResponseWriter, code int) {
-	w.WriteHeader(code)
-	w.Write([]byte(http.StatusText(code)))
+	ecode, ok := statusCodes[code]
+	if !ok {
+		ecode = codeInternal
+	}
+	fail(w, code, &apiError{Code: ecode, Message: http.StatusText(code)})
+}
+
+// failBadRequest 400s for a client mistake
+func failBadRequest(w http.ResponseWriter, code, msg string) {
+	fail(w, http.StatusBadRequest, &apiError{Code: code, Message: msg})
+}
+
+// failDecode 400s for a request body that didn't decode
+func failDecode(w http.ResponseWriter, err error) {
+	if isTooLarge(err) {
+		failBodyTooLarge(w)
+		return
+	}
+	failBadRequest(w, codeBadJSON, "invalid JSON request body: "+err.Error())
+}
+
+// retryAfter is the Retry-After value (in seconds) sent with 503s
+const retryAfter = "1"
+
+func failUnavailable(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", retryAfter)
+	fail(w, http.StatusServiceUnavailable, &apiError{Code: statusCodes[http.StatusServiceUnavailable], Message: msg})
 }
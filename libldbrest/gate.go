@@ -0,0 +1,84 @@
+package libldbrest
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// gate lets the global db be swapped out from underneath the endpoints.
+// every gated request holds a read lock for its duration, and while the gate
+// is paused (or the db isn't open) new requests are turned away with a 503
+// instead of queueing up.
+var gate requestGate
+
+type requestGate struct {
+	mu sync.RWMutex
+
+	// flags, accessed atomically
+	open, opened, paused, stopping int32
+}
+
+// setOpen records whether the global db is open
+func (g *requestGate) setOpen(open bool) {
+	if open {
+		atomic.StoreInt32(&g.opened, 1)
+		atomic.StoreInt32(&g.open, 1)
+	} else {
+		atomic.StoreInt32(&g.open, 0)
+	}
+}
+
+// pause stops letting new requests through and waits for in-flight ones to
+// finish. it must be followed by a call to resume.
+func (g *requestGate) pause() {
+	atomic.StoreInt32(&g.paused, 1)
+	g.mu.Lock()
+}
+
+func (g *requestGate) resume() {
+	g.mu.Unlock()
+	atomic.StoreInt32(&g.paused, 0)
+}
+
+// unavailable explains why requests can't be let through right now,
+// or is "" if they can
+func (g *requestGate) unavailable() string {
+	switch {
+	case atomic.LoadInt32(&g.stopping) == 1:
+		return "shutting down"
+	case atomic.LoadInt32(&g.paused) == 1:
+		return "database is being swapped"
+	case atomic.LoadInt32(&g.opened) == 0:
+		return "not finished initing DB"
+	case atomic.LoadInt32(&g.open) == 0:
+		return "database is not open"
+	}
+	return ""
+}
+
+// gated wraps an endpoint so that it runs only while the db is available
+func gated(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if reason := gate.unavailable(); reason != "" {
+			failUnavailable(w, reason)
+			return
+		}
+
+		gate.mu.RLock()
+		defer gate.mu.RUnlock()
+		h(w, r, p)
+	}
+}
+
+// StopServing turns away new requests with 503s and waits for in-flight ones
+// to finish, after which the db can be safely closed with CleanupDB. There's
+// no resuming afterwards.
+func StopServing() {
+	atomic.StoreInt32(&gate.stopping, 1)
+	cancelJobs()
+	restoreMu.Lock()
+	gate.pause()
+}
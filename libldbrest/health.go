@@ -0,0 +1,64 @@
+package libldbrest
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// healthz answers as long as the process is alive. with ?deep=yes it also
+// writes, reads back and deletes an internal key to make sure the db works.
+func healthz(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if r.URL.Query().Get("deep") == "yes" {
+		if reason := gate.unavailable(); reason != "" {
+			failUnavailable(w, reason)
+			return
+		}
+
+		gate.mu.RLock()
+		err := probeDB()
+		gate.mu.RUnlock()
+
+		if err != nil {
+			failUnavailable(w, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// readyz answers 200 only while requests are being let through to the db
+func readyz(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if reason := gate.unavailable(); reason != "" {
+		failUnavailable(w, reason)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+var errProbeMismatch = errors.New("read back a different value than was written")
+
+func probeDB() error {
+	key := internalKey("healthz")
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	if err := db.Put(wo, key, value); err != nil {
+		return err
+	}
+	got, err := db.Get(ro, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, value) {
+		return errProbeMismatch
+	}
+	return db.Delete(wo, key)
+}
@@ -0,0 +1,612 @@
+package libldbrest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmhodges/levigo"
+)
+
+// indexDef declares a secondary index: every key starting with Prefix whose
+// value is a JSON document with a scalar at Path (like "user.email" or
+// "tags.0") gets an entry mapping that scalar back to the key
+type indexDef struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+}
+
+var (
+	indexMu sync.RWMutex
+	indexes = make(map[string]*indexDef)
+)
+
+var validIndexName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// index definitions and entries live in the internal keyspace. entries are
+// the index's prefix + the encoded scalar + the key, with no value.
+func indexDefKey(name string) []byte {
+	return internalKey("indexdef/" + name)
+}
+
+func indexEntryPrefix(name string) []byte {
+	return internalKey("idx/" + name + "/")
+}
+
+// loadIndexes reads the index definitions out of the db
+func loadIndexes() error {
+	loaded := make(map[string]*indexDef)
+
+	it := db.NewIterator(ro)
+	defer it.Close()
+
+	prefix := indexDefKey("")
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		def := &indexDef{}
+		if err := json.Unmarshal(it.Value(), def); err != nil {
+			return err
+		}
+		loaded[def.Name] = def
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+
+	indexMu.Lock()
+	indexes = loaded
+	indexMu.Unlock()
+	return nil
+}
+
+// indexInfo is how indexes are described to clients
+type indexInfo struct {
+	*indexDef
+	Rebuild *rebuildStatus `json:"rebuild,omitempty"`
+}
+
+func listIndexes() []*indexDef {
+	indexMu.RLock()
+	defer indexMu.RUnlock()
+
+	defs := make([]*indexDef, 0, len(indexes))
+	for _, def := range indexes {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+func getIndex(name string) *indexDef {
+	indexMu.RLock()
+	defer indexMu.RUnlock()
+	return indexes[name]
+}
+
+// extract finds the scalar at the index's path in a JSON document
+func (def *indexDef) extract(doc interface{}) (interface{}, bool) {
+	for _, part := range strings.Split(def.Path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			doc = child
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// entryFor produces the index entry for key having (stored) value, if it has
+// one. values stored in chunks are too big to index.
+func (def *indexDef) entryFor(key, value []byte) ([]byte, bool) {
+	if value == nil || isInternal(key) || !bytes.HasPrefix(key, []byte(def.Prefix)) {
+		return nil, false
+	}
+
+	var doc interface{}
+	if json.Unmarshal(valueBody(value), &doc) != nil {
+		return nil, false
+	}
+	scalar, ok := def.extract(doc)
+	if !ok {
+		return nil, false
+	}
+	enc, ok := encodeIndexValue(scalar)
+	if !ok {
+		return nil, false
+	}
+
+	entry := indexEntryPrefix(def.Name)
+	entry = append(entry, enc...)
+	return append(entry, key...), true
+}
+
+// updateIndexes adds the index entry changes for key's value going from old
+// to value (either nil for a missing key) to the batch
+func (w *writer) updateIndexes(key, old, value []byte) {
+	indexMu.RLock()
+	defer indexMu.RUnlock()
+
+	for _, def := range indexes {
+		oldEntry, hadEntry := def.entryFor(key, old)
+		newEntry, hasEntry := def.entryFor(key, value)
+		if hadEntry && hasEntry && bytes.Equal(oldEntry, newEntry) {
+			continue
+		}
+		if hadEntry {
+			w.wb.Delete(oldEntry)
+		}
+		if hasEntry {
+			w.wb.Put(newEntry, nil)
+		}
+	}
+}
+
+// index values are encoded so that they sort sensibly as bytes: by type
+// (null < false < true < numbers < strings), then numerically or bytewise
+const (
+	tagNull   = 0x01
+	tagFalse  = 0x02
+	tagTrue   = 0x03
+	tagNumber = 0x04
+	tagString = 0x05
+)
+
+var errBadIndexValue = errors.New("malformed index entry")
+
+func encodeIndexValue(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case nil:
+		return []byte{tagNull}, true
+	case bool:
+		if v {
+			return []byte{tagTrue}, true
+		}
+		return []byte{tagFalse}, true
+	case float64:
+		// flip the sign bit of positives and every bit of negatives
+		// so the big-endian bytes sort in numeric order
+		bits := math.Float64bits(v)
+		if bits&(1<<63) == 0 {
+			bits |= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		enc := make([]byte, 9)
+		enc[0] = tagNumber
+		binary.BigEndian.PutUint64(enc[1:], bits)
+		return enc, true
+	case string:
+		// escape 0x00 as 0x00 0xff and terminate with 0x00 0x00, so a string
+		// sorts before its extensions and the key after it can be found
+		enc := []byte{tagString}
+		for _, b := range []byte(v) {
+			enc = append(enc, b)
+			if b == 0 {
+				enc = append(enc, 0xff)
+			}
+		}
+		return append(enc, 0, 0), true
+	}
+	return nil, false
+}
+
+// decodeIndexValue reverses encodeIndexValue, also returning
+// the length of the encoding at the start of b
+func decodeIndexValue(b []byte) (interface{}, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errBadIndexValue
+	}
+
+	switch b[0] {
+	case tagNull:
+		return nil, 1, nil
+	case tagFalse:
+		return false, 1, nil
+	case tagTrue:
+		return true, 1, nil
+	case tagNumber:
+		if len(b) < 9 {
+			return nil, 0, errBadIndexValue
+		}
+		bits := binary.BigEndian.Uint64(b[1:9])
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), 9, nil
+	case tagString:
+		var s []byte
+		for i := 1; i+1 < len(b); i++ {
+			if b[i] != 0 {
+				s = append(s, b[i])
+				continue
+			}
+			switch b[i+1] {
+			case 0:
+				return string(s), i + 2, nil
+			case 0xff:
+				s = append(s, 0)
+				i++
+			default:
+				return nil, 0, errBadIndexValue
+			}
+		}
+	}
+	return nil, 0, errBadIndexValue
+}
+
+// parseIndexValue reads a query parameter as a JSON scalar, or failing
+// that as a plain string (so ?value=42 is a number but ?value="42" and
+// ?value=abc are strings)
+func parseIndexValue(s string) ([]byte, bool) {
+	var v interface{}
+	if json.Unmarshal([]byte(s), &v) != nil {
+		v = s
+	}
+	return encodeIndexValue(v)
+}
+
+// indexHit is one entry found in an index query
+type indexHit struct {
+	Key        string      `json:"key"`
+	IndexValue interface{} `json:"index_value"`
+	Value      *string     `json:"value,omitempty"`
+}
+
+// indexQuery describes a range of an index to read. lo and hi are bounds
+// on the entries' encoded scalar+key (hi nil is unbounded).
+type indexQuery struct {
+	def           *indexDef
+	lo, hi        []byte
+	max           int
+	includeValues bool
+
+	// filter leaves out keys the client may not read
+	filter func(key []byte) bool
+}
+
+// run reads the hits, also reporting whether there were more before hi and
+// the cursor to continue from
+func (q *indexQuery) run(ctx context.Context) (hits []*indexHit, more bool, cursor string, err error) {
+	prefix := indexEntryPrefix(q.def.Name)
+	hi := prefixEnd(prefix)
+	if q.hi != nil {
+		hi = append(append([]byte{}, prefix...), q.hi...)
+	}
+
+	ropts := levigo.NewReadOptions()
+	defer ropts.Close()
+	ropts.SetFillCache(false)
+
+	it := db.NewIterator(ropts)
+	defer it.Close()
+
+	hits = make([]*indexHit, 0)
+	for it.Seek(append(append([]byte{}, prefix...), q.lo...)); it.Valid(); it.Next() {
+		entry := it.Key()
+		if bytes.Compare(entry, hi) >= 0 {
+			break
+		}
+		if len(hits) >= q.max {
+			more = true
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		suffix := entry[len(prefix):]
+		scalar, n, derr := decodeIndexValue(suffix)
+		if derr != nil {
+			err = derr
+			return
+		}
+		key := suffix[n:]
+		cursor = hex.EncodeToString(suffix)
+
+		if q.filter != nil && !q.filter(key) {
+			continue
+		}
+
+		hit := &indexHit{Key: string(key), IndexValue: scalar}
+		if q.includeValues {
+			value, gerr := db.Get(ro, key)
+			if gerr != nil {
+				err = gerr
+				return
+			}
+			if value == nil {
+				continue
+			}
+			if _, value, err = loadValue(ro, value); err != nil {
+				return
+			}
+			s := string(value)
+			hit.Value = &s
+			valueBytesRead.add("", float64(len(value)))
+		}
+		hits = append(hits, hit)
+	}
+	if err == nil {
+		err = it.GetError()
+	}
+	if !more {
+		cursor = ""
+	}
+	return
+}
+
+// createIndex stores a new (or replacement) index definition, after which
+// writes maintain its entries. entries for existing data come from rebuild.
+func createIndex(def *indexDef) error {
+	b, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if err := db.Put(wo, indexDefKey(def.Name), b); err != nil {
+		return err
+	}
+
+	indexMu.Lock()
+	indexes[def.Name] = def
+	indexMu.Unlock()
+	return nil
+}
+
+// dropIndex removes an index's definition and then all its entries
+func dropIndex(ctx context.Context, name string) error {
+	cancelRebuild(name)
+
+	writeMu.Lock()
+	err := db.Delete(wo, indexDefKey(name))
+	if err == nil {
+		indexMu.Lock()
+		delete(indexes, name)
+		indexMu.Unlock()
+	}
+	writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = clearIndex(ctx, name, oneChunk)
+	return err
+}
+
+func clearIndex(ctx context.Context, name string, step chunkStep) (int, error) {
+	prefix := indexEntryPrefix(name)
+	return eachChunk(ctx, prefix, prefixEnd(prefix), step, func(wb *levigo.WriteBatch, key, value []byte) {
+		wb.Delete(key)
+	})
+}
+
+// chunkSize is how many keys are handled at once in long-running writes
+const chunkSize = 1000
+
+// chunkStep runs fn over up to chunkSize keys in [start, end) (a nil end is
+// unbounded), returning how many it saw and the key to continue from (nil
+// when there are no more)
+type chunkStep func(ctx context.Context, start, end []byte, fn chunkFunc) (int, []byte, error)
+
+// chunkFunc adds the writes for one key to a chunk's batch
+type chunkFunc func(wb *levigo.WriteBatch, key, value []byte)
+
+// eachChunk runs fn over every key in [start, end) a step at a time
+func eachChunk(ctx context.Context, start, end []byte, step chunkStep, fn chunkFunc) (int, error) {
+	var total int
+	for cursor := start; cursor != nil; {
+		var (
+			n   int
+			err error
+		)
+		n, cursor, err = step(ctx, cursor, end, fn)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// oneChunk is the chunkStep for callers already inside the gate. it holds
+// the write lock so client writes can't interleave with the chunk, and
+// writes the chunk's batch atomically.
+func oneChunk(ctx context.Context, start, end []byte, fn chunkFunc) (int, []byte, error) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	ropts := levigo.NewReadOptions()
+	defer ropts.Close()
+	ropts.SetFillCache(false)
+
+	it := db.NewIterator(ropts)
+	defer it.Close()
+
+	var (
+		n    int
+		next []byte
+	)
+	if len(start) == 0 {
+		it.SeekToFirst()
+	} else {
+		it.Seek(start)
+	}
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if end != nil && compareKeys(key, end) >= 0 {
+			break
+		}
+		if n == chunkSize {
+			next = key
+			break
+		}
+		fn(wb, key, it.Value())
+		n++
+	}
+	if err := it.GetError(); err != nil {
+		return n, nil, err
+	}
+
+	return n, next, db.Write(wo, wb)
+}
+
+// jobChunk is the chunkStep for background jobs. it holds off a /restore or
+// shutdown until the chunk is written (the job is cancelled before either
+// gets going, which oneChunk notices).
+func jobChunk(ctx context.Context, start, end []byte, fn chunkFunc) (int, []byte, error) {
+	gate.mu.RLock()
+	defer gate.mu.RUnlock()
+	return oneChunk(ctx, start, end, fn)
+}
+
+// rebuildStatus reports on an index's latest rebuild job
+type rebuildStatus struct {
+	State   string `json:"state"` // "running", "done", "failed" or "cancelled"
+	Scanned int    `json:"scanned"`
+	Error   string `json:"error,omitempty"`
+}
+
+var rebuilds = struct {
+	sync.Mutex
+	status map[string]*rebuildStatus
+	cancel map[string]context.CancelFunc
+}{
+	status: make(map[string]*rebuildStatus),
+	cancel: make(map[string]context.CancelFunc),
+}
+
+func rebuildState(name string) *rebuildStatus {
+	rebuilds.Lock()
+	defer rebuilds.Unlock()
+	if st, ok := rebuilds.status[name]; ok {
+		copied := *st
+		return &copied
+	}
+	return nil
+}
+
+func cancelRebuild(name string) {
+	rebuilds.Lock()
+	defer rebuilds.Unlock()
+	if cancel, ok := rebuilds.cancel[name]; ok {
+		cancel()
+	}
+}
+
+// cancelJobs stops all background jobs, as when the db is about
+// to be closed or swapped out
+func cancelJobs() {
+	rebuilds.Lock()
+	defer rebuilds.Unlock()
+	for _, cancel := range rebuilds.cancel {
+		cancel()
+	}
+}
+
+// startRebuild regenerates an index's entries in the background,
+// replacing any rebuild of it already running
+func startRebuild(def *indexDef) {
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &rebuildStatus{State: "running"}
+
+	rebuilds.Lock()
+	if old, ok := rebuilds.cancel[def.Name]; ok {
+		old()
+	}
+	rebuilds.cancel[def.Name] = cancel
+	rebuilds.status[def.Name] = st
+	rebuilds.Unlock()
+
+	go func() {
+		defer cancel()
+		scanned, err := rebuild(ctx, def, func(n int) {
+			rebuilds.Lock()
+			st.Scanned = n
+			rebuilds.Unlock()
+		})
+
+		rebuilds.Lock()
+		defer rebuilds.Unlock()
+		st.Scanned = scanned
+		switch {
+		case err == nil:
+			st.State = "done"
+		case ctx.Err() != nil:
+			st.State = "cancelled"
+		default:
+			st.State, st.Error = "failed", err.Error()
+		}
+		if rebuilds.status[def.Name] == st {
+			delete(rebuilds.cancel, def.Name)
+		}
+	}()
+}
+
+// rebuild clears an index's entries and then indexes every key under its
+// prefix, a chunk at a time. writes in the meantime maintain entries for
+// the keys they touch as usual.
+func rebuild(ctx context.Context, def *indexDef, progress func(int)) (int, error) {
+	if _, err := clearIndex(ctx, def.Name, jobChunk); err != nil {
+		return 0, err
+	}
+
+	var (
+		scanned int
+		err     error
+	)
+	start := []byte(def.Prefix)
+	end := prefixEnd(start)
+	if keyOrder.custom() {
+		// the prefix's keys could be anywhere among the client keys
+		start, end = []byte{}, []byte(internalPrefix)
+	}
+	for cursor := start; cursor != nil; {
+		var n int
+		n, cursor, err = jobChunk(ctx, cursor, end, func(wb *levigo.WriteBatch, key, value []byte) {
+			if isInternal(key) {
+				return
+			}
+			if entry, ok := def.entryFor(key, value); ok {
+				wb.Put(entry, nil)
+			}
+		})
+		scanned += n
+		progress(scanned)
+		if err != nil {
+			return scanned, err
+		}
+	}
+	return scanned, nil
+}
@@ -0,0 +1,38 @@
+package libldbrest
+
+import (
+	"bytes"
+
+	"github.com/jmhodges/levigo"
+)
+
+// internalPrefix starts every key ldbrest keeps for its own bookkeeping
+const internalPrefix = "\x00ldbrest\x00"
+
+// internalKey builds the key for a piece of ldbrest's own data
+func internalKey(name string) []byte {
+	return []byte(internalPrefix + name)
+}
+
+func isInternal(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(internalPrefix))
+}
+
+// skipInternal moves an iterator sitting in the internal keyspace to the
+// nearest client key in its direction, reporting whether there is one.
+// custom comparators put the internal keyspace after every client key.
+func skipInternal(it *levigo.Iterator, backwards bool) bool {
+	if backwards {
+		it.Seek([]byte(internalPrefix))
+		if it.Valid() {
+			it.Prev()
+		}
+	} else if keyOrder.custom() {
+		return false
+	} else if end := prefixEnd([]byte(internalPrefix)); end != nil {
+		it.Seek(end)
+	} else {
+		return false
+	}
+	return it.Valid()
+}
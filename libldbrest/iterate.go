@@ -2,9 +2,15 @@ package libldbrest
 
 import (
 	"bytes"
+	"errors"
+
 	"github.com/jmhodges/levigo"
 )
 
+// errSkipped is for handlers to leave a key out of an iteration, in which case
+// it doesn't count towards the max
+var errSkipped = errors.New("key skipped")
+
 func iterate(start []byte, include_start, backwards bool, handle func([]byte, []byte) (bool, error)) error {
 	ropts := levigo.NewReadOptions()
 	defer ropts.Close()
@@ -30,18 +36,31 @@ func iterate(start []byte, include_start, backwards bool, handle func([]byte, []
 
 		// levigo *Iterator.Seek() seeks to the first key >= its argument, but
 		// going backwards we need the last key <= the arg, so adjust accordingly
-		if !it.Valid() {
+		if len(start) == 0 {
+			// already at the last key
+		} else if !it.Valid() {
 			it.SeekToLast()
-		} else if !include_start && !bytes.Equal(it.Key(), start) {
+		} else if !bytes.Equal(it.Key(), start) {
 			it.Prev()
 		}
 	} else {
 		proceed = it.Next
 	}
 
+	// ldbrest's own keys aren't part of the client-visible keyspace (but a
+	// bucket's keys are in there, so iterations starting in a bucket, which
+	// are always bounded by its prefix, go ahead)
+	hideInternal := !isInternal(start)
+
 	first := true
 
 	for ; it.Valid(); proceed() {
+		if hideInternal && isInternal(it.Key()) {
+			if !skipInternal(it, backwards) {
+				break
+			}
+		}
+
 		if first && !include_start && bytes.Equal(it.Key(), start) {
 			first = false
 			continue
@@ -68,7 +87,7 @@ func iterateUntil(start, end []byte, max int, include_start, include_end, backwa
 	)
 
 	oob := func(key []byte) (bool, bool) { // returns (valid_now, check_more)
-		cmp := bytes.Compare(key, end)
+		cmp := compareKeys(key, end)
 		switch {
 		case cmp == 0:
 			return include_end, false
@@ -85,16 +104,18 @@ func iterateUntil(start, end []byte, max int, include_start, include_end, backwa
 			more, _ = oob(key)
 			return true, nil
 		}
-		i++
 
 		valid, next := oob(key)
 		if !valid {
 			return true, nil
 		}
 
-		if err := handle(key, value); err != nil {
+		if err := handle(key, value); err == errSkipped {
+			return !next, nil
+		} else if err != nil {
 			return true, err
 		}
+		i++
 
 		return !next, nil
 	})
@@ -102,13 +123,46 @@ func iterateUntil(start, end []byte, max int, include_start, include_end, backwa
 	return more, err
 }
 
+// iterateParts runs an iteration over each of parts in turn until max keys
+// have been handled (not counting skipped ones), reporting whether there
+// were more before the end
+func iterateParts(parts []*iterBounds, max int, handle func([]byte, []byte) error) (bool, error) {
+	n := 0
+	counted := func(key, value []byte) error {
+		err := handle(key, value)
+		if err == nil {
+			n++
+		}
+		return err
+	}
+	for _, part := range parts {
+		if len(part.end) == 0 {
+			// only ever the last part, and unbounded ones don't report "more"
+			if n < max {
+				return false, iterateN(part.start, max-n, part.include_start, part.backwards, counted)
+			}
+			return false, nil
+		}
+		more, err := iterateUntil(part.start, part.end, max-n, part.include_start, part.include_end, part.backwards, counted)
+		if err != nil || more {
+			return more, err
+		}
+	}
+	return false, nil
+}
+
 func iterateN(start []byte, max int, include_start, backwards bool, handle func([]byte, []byte) error) error {
 	var i int
 	return iterate(start, include_start, backwards, func(key, value []byte) (bool, error) {
 		if i >= max {
 			return true, nil
 		}
+		if err := handle(key, value); err == errSkipped {
+			return false, nil
+		} else if err != nil {
+			return true, err
+		}
 		i++
-		return false, handle(key, value)
+		return false, nil
 	})
 }
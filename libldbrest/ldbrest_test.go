@@ -1,15 +1,23 @@
 package libldbrest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jmhodges/levigo"
 )
@@ -148,6 +156,67 @@ func TestIteration(t *testing.T) {
 	assert(t, kresp.Data[1] == "c", "wrong data[1]: %s", kresp.Data[1])
 }
 
+func TestBackwardsSeek(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.put("c", "C")
+	app.put("e", "E")
+
+	for url, want := range map[string]string{
+		// a start key that isn't there begins at the key before it,
+		// whether or not the start is included
+		"forward=no&start=d":                  `["c","a"]`,
+		"forward=no&start=d&include_start=no": `["c","a"]`,
+		"forward=no&start=c":                  `["c","a"]`,
+		"forward=no&start=c&include_start=no": `["a"]`,
+		"forward=no&start=z":                  `["e","c","a"]`,
+		"forward=no":                          `["e","c","a"]`,
+		"forward=no&end=b":                    `["e","c"]`,
+	} {
+		rr := app.doReq("GET", "http://domain/iterate?include_values=no&"+url, "")
+		got := strings.TrimSpace(rr.Body.String())
+		assert(t, got == `{"more":false,"data":`+want+`}`, "GET /iterate?%s: %s", url, got)
+	}
+}
+
+func TestIterateSkipped(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		app.put(key, key)
+	}
+
+	// only vowels are kept, and skipped keys don't count towards max
+	run := func(bounds *iterBounds, max int) (string, bool) {
+		var keys []string
+		more, err := iterateParts([]*iterBounds{bounds}, max, func(key, value []byte) error {
+			if !strings.ContainsAny(string(key), "ae") {
+				return errSkipped
+			}
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ","), more
+	}
+
+	keys, more := run(&iterBounds{start: []byte("a"), end: []byte("f"), include_start: true, include_end: true}, 1)
+	assert(t, keys == "a" && more, "wrong first page: %s %v", keys, more)
+	keys, more = run(&iterBounds{start: []byte("a"), end: []byte("f"), include_end: true}, 1)
+	assert(t, keys == "e" && more, "page after skipped keys came back short: %s %v", keys, more)
+	keys, more = run(&iterBounds{start: []byte("e"), end: []byte("f"), include_end: true}, 1)
+	assert(t, keys == "" && !more, "wrong last page: %s %v", keys, more)
+	keys, more = run(&iterBounds{start: []byte("a"), include_start: true}, 2)
+	assert(t, keys == "a,e" && !more, "unbounded iteration came back short: %s %v", keys, more)
+}
+
 func TestBatch(t *testing.T) {
 	dbpath := setup(t)
 	defer cleanup(dbpath)
@@ -172,6 +241,1356 @@ func TestBatch(t *testing.T) {
 	}
 }
 
+func TestPartialSnapshot(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("t1/a", "A")
+	app.put("t1/b", "B")
+	app.put("t1/c", "C")
+	app.put("t2/a", "X")
+
+	dest := dbpath + "_snap"
+	defer os.RemoveAll(dest)
+
+	body, err := json.Marshal(map[string]string{
+		"destination":  dest,
+		"prefix":       "t1/",
+		"end":          "t1/c",
+		"strip_prefix": "t1/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := app.doReq("POST", "http://domain/snapshot", string(body))
+	if rr.Code != 204 {
+		t.Fatalf("bad POST /snapshot response: %d", rr.Code)
+	}
+
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	snap, err := levigo.Open(dest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	it := snap.NewIterator(ro)
+	defer it.Close()
+	var keys []string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	assert(t, len(keys) == 2, "wrong # of snapshotted keys: %d", len(keys))
+	assert(t, keys[0] == "a", "wrong snapshotted key: %s", keys[0])
+	assert(t, keys[1] == "b", "wrong snapshotted key: %s", keys[1])
+}
+
+func TestRangeSnapshot(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.put("t/", "T")
+	app.put("t/a", `{"n": 1}`)
+	app.doReq("PUT", "http://domain/b/bkt", "")
+	app.doReq("PUT", "http://domain/b/bkt/key/x", "X")
+	rr := app.doReq("PUT", "http://domain/index/n", `{"prefix": "t/", "path": "n"}`)
+	assert(t, rr.Code == 202, "bad PUT /index response: %d", rr.Code)
+	// let the rebuild finish so the db isn't closed under it
+	for i := 0; i < 100; i++ {
+		if st := rebuildState("n"); st != nil && st.State != "running" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	snapKeys := func(body string) []string {
+		dest := dbpath + "_snap"
+		defer os.RemoveAll(dest)
+		rr := app.doReq("POST", "http://domain/snapshot", strings.Replace(body, "DEST", dest, 1))
+		assert(t, rr.Code == 204, "bad POST /snapshot response: %d", rr.Code)
+
+		opts := levigo.NewOptions()
+		defer opts.Close()
+		snap, err := levigo.Open(dest, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+		it := snap.NewIterator(ro)
+		defer it.Close()
+		var keys []string
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return keys
+	}
+
+	// a range covering the internal keyspace doesn't copy it
+	keys := snapKeys(`{"destination": "DEST", "end": "z"}`)
+	assert(t, strings.Join(keys, ",") == "a,t/,t/a", "internal keys in a range snapshot: %q", keys)
+
+	// stripping the prefix off the key that's just the prefix leaves it out
+	keys = snapKeys(`{"destination": "DEST", "prefix": "t/", "strip_prefix": "t/"}`)
+	assert(t, strings.Join(keys, ",") == "a", "wrong stripped snapshot: %q", keys)
+
+	// as stripping a prefix that not every copied key has could collide
+	rr = app.doReq("POST", "http://domain/snapshot", fmt.Sprintf(`{"destination": %q, "strip_prefix": "t/"}`, dbpath+"_snap"))
+	assert(t, rr.Code == 400, "wrong code for a strip_prefix outside the prefix: %d", rr.Code)
+}
+
+func TestRestore(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "before")
+
+	dest := dbpath + "_snap"
+	defer os.RemoveAll(dest)
+	rr := app.doReq("POST", "http://domain/snapshot", fmt.Sprintf(`{"destination": %q}`, dest))
+	if rr.Code != 204 {
+		t.Fatalf("bad POST /snapshot response: %d", rr.Code)
+	}
+
+	app.put("a", "after")
+
+	rr = app.doReq("POST", "http://domain/restore", fmt.Sprintf(`{"source": %q}`, dest))
+	if rr.Code != 204 {
+		t.Fatalf("bad POST /restore response: %d", rr.Code)
+	}
+	assert(t, app.get("a") == "before", "restore didn't swap in the snapshot")
+
+	rr = app.doReq("POST", "http://domain/restore", `{"undo": true}`)
+	if rr.Code != 204 {
+		t.Fatalf("bad POST /restore undo response: %d", rr.Code)
+	}
+	assert(t, app.get("a") == "after", "undo didn't swap back the previous db")
+
+	// the snapshot was copied, not used up
+	rr = app.doReq("POST", "http://domain/restore", fmt.Sprintf(`{"source": %q}`, dest))
+	assert(t, rr.Code == 204, "bad second POST /restore response: %d", rr.Code)
+	assert(t, app.get("a") == "before", "second restore didn't swap in the snapshot")
+}
+
+func TestFinishSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldbrest_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+	mark := func(path, name string) {
+		os.MkdirAll(path, 0755)
+		ioutil.WriteFile(filepath.Join(path, "NAME"), []byte(name), 0644)
+	}
+	name := func(path string) string {
+		b, _ := ioutil.ReadFile(filepath.Join(path, "NAME"))
+		return string(b)
+	}
+
+	// no journal: nothing to do, even with a stray swap directory
+	mark(path, "current")
+	mark(swapPath(path), "stray")
+	assert(t, finishSwap(path) == nil, "finishSwap failed")
+	assert(t, name(path) == "current" && name(swapPath(path)) == "stray", "finishSwap acted without a journal")
+	os.RemoveAll(swapPath(path))
+
+	// died with the old db moved aside and nothing in its place
+	os.Rename(path, swapPath(path))
+	ioutil.WriteFile(swapJournal(path), nil, 0644)
+	assert(t, finishSwap(path) == nil, "finishSwap failed")
+	assert(t, name(path) == "current", "finishSwap didn't put the old db back")
+
+	// died with the new db in place but the old one not yet moved on
+	os.Rename(path, swapPath(path))
+	mark(path, "new")
+	ioutil.WriteFile(swapJournal(path), nil, 0644)
+	assert(t, finishSwap(path) == nil, "finishSwap failed")
+	assert(t, name(path) == "new" && name(path+".prev") == "current", "finishSwap didn't finish the swap")
+	_, err = os.Stat(swapJournal(path))
+	assert(t, os.IsNotExist(err), "finishSwap left the journal")
+}
+
+func TestGatePaused(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	atomic.StoreInt32(&gate.paused, 1)
+	defer atomic.StoreInt32(&gate.paused, 0)
+
+	rr := app.doReq("GET", "http://domain/key/a", "")
+	assert(t, rr.Code == 503, "wrong response code while paused: %d", rr.Code)
+	assert(t, rr.HeaderMap.Get("Retry-After") != "", "missing Retry-After header")
+}
+
+func TestAuth(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	tokens = map[string]role{"r": roleRead, "w": roleWrite}
+	defer func() { tokens = nil }()
+
+	app := newAppTester(t)
+
+	authReq := func(method, url, body, token string) int {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		app.app.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	code := authReq("PUT", "http://domain/key/a", "A", "")
+	assert(t, code == 401, "wrong code for missing token: %d", code)
+
+	code = authReq("PUT", "http://domain/key/a", "A", "bogus")
+	assert(t, code == 401, "wrong code for unknown token: %d", code)
+
+	code = authReq("PUT", "http://domain/key/a", "A", "r")
+	assert(t, code == 403, "wrong code for read token PUT: %d", code)
+
+	code = authReq("PUT", "http://domain/key/a", "A", "w")
+	assert(t, code == 204, "wrong code for write token PUT: %d", code)
+
+	code = authReq("GET", "http://domain/key/a", "", "r")
+	assert(t, code == 200, "wrong code for read token GET: %d", code)
+
+	code = authReq("GET", "http://domain/property/leveldb.stats", "", "w")
+	assert(t, code == 403, "wrong code for write token GET /property: %d", code)
+}
+
+func TestACL(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.put("t1/a", "A1")
+	app.put("t1/b", "B1")
+	app.put("t2/a", "A2")
+	app.put("z", "Z")
+
+	tokens = map[string]role{"t1": roleWrite}
+	acl = map[string][]aclRule{"token:t1": {{aclRead | aclWrite, []byte("t1/")}}}
+	defer func() { tokens, acl = nil, nil }()
+
+	authReq := func(method, url, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer t1")
+		rr := httptest.NewRecorder()
+		app.app.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := authReq("GET", "http://domain/key/t1/a", "")
+	assert(t, rr.Code == 200, "wrong code for allowed GET: %d", rr.Code)
+
+	rr = authReq("GET", "http://domain/key/t2/a", "")
+	assert(t, rr.Code == 403, "wrong code for disallowed GET: %d", rr.Code)
+
+	rr = authReq("POST", "http://domain/keys", `{"keys": ["t1/a", "t2/a"]}`)
+	assert(t, rr.Code == 403, "wrong code for disallowed POST /keys: %d", rr.Code)
+
+	rr = authReq("POST", "http://domain/batch", `{"ops": [{"op": "put", "key": "t2/b", "value": "B2"}]}`)
+	assert(t, rr.Code == 403, "wrong code for disallowed POST /batch: %d", rr.Code)
+
+	for _, url := range []string{
+		"http://domain/iterate?include_values=no",
+		"http://domain/iterate?forward=no&include_values=no",
+	} {
+		rr = authReq("GET", url, "")
+		assert(t, rr.Code == 200, "bad GET /iterate response: %d", rr.Code)
+		kresp := &struct{ Data []string }{}
+		if err := json.NewDecoder(rr.Body).Decode(kresp); err != nil {
+			t.Fatal(err)
+		}
+		assert(t, len(kresp.Data) == 2, "wrong # of clamped keys: %d", len(kresp.Data))
+		for _, key := range kresp.Data {
+			assert(t, strings.HasPrefix(key, "t1/"), "iterated a disallowed key: %s", key)
+		}
+	}
+
+	// iterations go on from one allowed prefix to the next
+	acl["token:t1"] = append(acl["token:t1"], aclRule{aclRead, []byte("z")})
+	for url, want := range map[string]string{
+		"":                             `{"more":false,"data":["t1/a","t1/b","z"]}`,
+		"&forward=no":                  `{"more":false,"data":["z","t1/b","t1/a"]}`,
+		"&start=t1/b&include_start=no": `{"more":false,"data":["z"]}`,
+		"&max=2&end=zz":                `{"more":true,"data":["t1/a","t1/b"],"last":"t1/b"}`,
+		"&max=2&end=z":                 `{"more":false,"data":["t1/a","t1/b"]}`,
+		"&max=2&end=z&include_end=yes": `{"more":true,"data":["t1/a","t1/b"],"last":"t1/b"}`,
+		"&forward=no&start=t2/a&end=t1/b&include_end=yes": `{"more":false,"data":["t1/b"]}`,
+		"&forward=no&max=1&end=t1/a":                      `{"more":true,"data":["z"],"last":"z"}`,
+		"&forward=no&start=t1/c":                          `{"more":false,"data":["t1/b","t1/a"]}`,
+	} {
+		rr = authReq("GET", "http://domain/iterate?include_values=no"+url, "")
+		got := strings.TrimSpace(rr.Body.String())
+		assert(t, got == want, "GET /iterate%s across prefixes: %s", url, got)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	rr := app.doReq("GET", "http://domain/healthz?deep=yes", "")
+	assert(t, rr.Code == 200, "bad deep GET /healthz response: %d", rr.Code)
+
+	rr = app.doReq("GET", "http://domain/readyz", "")
+	assert(t, rr.Code == 200, "bad GET /readyz response: %d", rr.Code)
+
+	gate.setOpen(false)
+	rr = app.doReq("GET", "http://domain/readyz", "")
+	assert(t, rr.Code == 503, "GET /readyz with closed db: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/healthz", "")
+	assert(t, rr.Code == 200, "GET /healthz with closed db: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/key/a", "")
+	assert(t, rr.Code == 503, "GET /key with closed db: %d", rr.Code)
+}
+
+func TestMetrics(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.get("a")
+
+	rr := app.doReq("GET", "http://domain/metrics", "")
+	assert(t, rr.Code == 200, "bad GET /metrics response: %d", rr.Code)
+
+	body := rr.Body.String()
+	for _, line := range []string{
+		`ldbrest_requests_total{route="key",method="PUT",code="204"} `,
+		`ldbrest_requests_total{route="key",method="GET",code="200"} `,
+		`ldbrest_request_duration_seconds_bucket{route="key",method="GET",le="+Inf"} `,
+		`ldbrest_leveldb_num_files{level="0"} `,
+	} {
+		assert(t, strings.Contains(body, line), "missing metric line: %s", line)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	buf := &bytes.Buffer{}
+	if err := SetAccessLog(buf, "json", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { accessLog.out = nil }()
+
+	app := newAppTester(t)
+	app.put("foo", "bar")
+
+	line := &struct {
+		Method, Route, Target string
+		Status, Bytes         int
+	}{}
+	if err := json.Unmarshal(buf.Bytes(), line); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, line.Method == "PUT", "wrong logged method: %s", line.Method)
+	assert(t, line.Route == "key", "wrong logged route: %s", line.Route)
+	assert(t, line.Target == "foo", "wrong logged target: %s", line.Target)
+	assert(t, line.Status == 204, "wrong logged status: %d", line.Status)
+}
+
+// readFromRecorder notes whether it was written to with ReadFrom
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (rr *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rr.readFrom = true
+	return io.Copy(rr.ResponseRecorder, src)
+}
+
+func TestStatusRecorder(t *testing.T) {
+	rr := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	sr := &statusRecorder{ResponseWriter: rr}
+
+	n, err := io.Copy(sr, struct{ io.Reader }{strings.NewReader("hello")})
+	assert(t, err == nil && n == 5, "copy to the recorder: %d %v", n, err)
+	assert(t, rr.readFrom, "io.Copy didn't reach the underlying ReadFrom")
+	assert(t, sr.bytes == 5 && sr.status() == 200, "wrong recorded size or status: %d %d", sr.bytes, sr.status())
+
+	sr.Flush()
+	assert(t, rr.Flushed, "Flush didn't reach the underlying ResponseWriter")
+}
+
+func TestErrorBodies(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	decodeErr := func(rr *httptest.ResponseRecorder) *apiError {
+		body := &struct{ Error *apiError }{}
+		if err := json.NewDecoder(rr.Body).Decode(body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error == nil {
+			t.Fatal("missing error in response body")
+		}
+		return body.Error
+	}
+
+	rr := app.doReq("POST", "http://domain/keys", "{not json")
+	assert(t, rr.Code == 400, "wrong code for malformed /keys body: %d", rr.Code)
+	ae := decodeErr(rr)
+	assert(t, ae.Code == codeBadJSON, "wrong error code: %s", ae.Code)
+
+	rr = app.doReq("GET", "http://domain/iterate?max=lots", "")
+	assert(t, rr.Code == 400, "wrong code for non-numeric max: %d", rr.Code)
+	ae = decodeErr(rr)
+	assert(t, ae.Code == codeBadParam, "wrong error code: %s", ae.Code)
+
+	rr = app.doReq("POST", "http://domain/batch", `{"ops": [{"op": "put", "key": "a"}, {"op": "frob", "key": "b"}]}`)
+	assert(t, rr.Code == 400, "wrong code for bad batch op: %d", rr.Code)
+	ae = decodeErr(rr)
+	assert(t, ae.Code == codeBadBatchOp, "wrong error code: %s", ae.Code)
+	assert(t, ae.OpIndex != nil && *ae.OpIndex == 1, "wrong op_index: %v", ae.OpIndex)
+
+	rr = app.doReq("GET", "http://domain/key/missing", "")
+	assert(t, rr.Code == 404, "wrong code for missing key: %d", rr.Code)
+	ae = decodeErr(rr)
+	assert(t, ae.Code == "not_found", "wrong error code: %s", ae.Code)
+}
+
+func TestLimits(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	SetLimits(Limits{MaxBodySize: 100, MaxValueSize: 10, MaxKeyLength: 5, MaxKeys: 2, MaxBatchOps: 2})
+	defer SetLimits(DefaultLimits)
+
+	app := newAppTester(t)
+
+	rr := app.doReq("PUT", "http://domain/key/a", strings.Repeat("x", 11))
+	assert(t, rr.Code == 413, "wrong code for too large a value: %d", rr.Code)
+
+	rr = app.doReq("PUT", "http://domain/key/abcdef", "x")
+	assert(t, rr.Code == 400, "wrong code for too long a key: %d", rr.Code)
+
+	rr = app.doReq("POST", "http://domain/keys", `{"keys": ["a", "b", "c"]}`)
+	assert(t, rr.Code == 400, "wrong code for too many keys: %d", rr.Code)
+
+	rr = app.doReq("POST", "http://domain/keys", `{"keys": ["`+strings.Repeat("a", 100)+`"]}`)
+	assert(t, rr.Code == 413, "wrong code for too large a body: %d", rr.Code)
+
+	rr = app.doReq("POST", "http://domain/batch", `{"ops": [{"op": "put", "key": "a", "value": "`+strings.Repeat("x", 11)+`"}]}`)
+	assert(t, rr.Code == 400, "wrong code for too large a batch value: %d", rr.Code)
+
+	rr = app.doReq("GET", "http://domain/limits", "")
+	assert(t, rr.Code == 200, "bad GET /limits response: %d", rr.Code)
+	got := &Limits{}
+	if err := json.NewDecoder(rr.Body).Decode(got); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, got.MaxKeys == 2, "wrong max_keys from /limits: %d", got.MaxKeys)
+}
+
+func TestRateLimit(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	SetRateLimits(RateLimit{}, RateLimit{Rate: 0.001, Burst: 2}, RateLimit{})
+	defer SetRateLimits(RateLimit{}, RateLimit{}, RateLimit{})
+
+	app := newAppTester(t)
+	app.put("a", "A")
+	app.put("b", "B")
+
+	rr := app.doReq("PUT", "http://domain/key/c", "C")
+	assert(t, rr.Code == 429, "wrong code over the write rate limit: %d", rr.Code)
+	assert(t, rr.HeaderMap.Get("Retry-After") != "", "missing Retry-After header")
+
+	// reads are limited separately
+	app.get("a")
+}
+
+func TestIndexes(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("users/1", `{"email": "a@example.com", "age": 30}`)
+	app.put("users/2", `{"email": "b@example.com", "age": 25}`)
+	app.put("other/1", `{"email": "a@example.com"}`)
+
+	build := func(name, body string) {
+		rr := app.doReq("PUT", "http://domain/index/"+name, body)
+		assert(t, rr.Code == 202, "bad PUT /index/%s response: %d", name, rr.Code)
+		for i := 0; i < 100; i++ {
+			if st := rebuildState(name); st != nil && st.State != "running" {
+				assert(t, st.State == "done", "rebuild of %s ended up %s: %s", name, st.State, st.Error)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("rebuild of %s never finished", name)
+	}
+	build("email", `{"prefix": "users/", "path": "email"}`)
+
+	// bucket keys can't be indexed, rather than getting an index that stays empty
+	bucketPrefix, _ := json.Marshal(string(internalKey("b/")))
+	rr := app.doReq("PUT", "http://domain/index/inbucket", `{"prefix": `+string(bucketPrefix)+`, "path": "email"}`)
+	assert(t, rr.Code == 400, "bad PUT /index with a bucket prefix response: %d", rr.Code)
+	assert(t, getIndex("inbucket") == nil, "index over bucket keys was created")
+	build("age", `{"prefix": "users/", "path": "age"}`)
+
+	lookup := func(query string) []string {
+		rr := app.doReq("GET", "http://domain/index/"+query, "")
+		assert(t, rr.Code == 200, "bad GET /index/%s response: %d", query, rr.Code)
+		body := &struct{ Data []*indexHit }{}
+		if err := json.NewDecoder(rr.Body).Decode(body); err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, len(body.Data))
+		for i, hit := range body.Data {
+			keys[i] = hit.Key
+		}
+		return keys
+	}
+
+	keys := lookup("email?value=a@example.com")
+	assert(t, len(keys) == 1 && keys[0] == "users/1", "wrong email lookup: %v", keys)
+	keys = lookup("age?start=20&end=30")
+	assert(t, len(keys) == 1 && keys[0] == "users/2", "wrong age range: %v", keys)
+	keys = lookup("age?start=20&end=30&include_end=yes")
+	assert(t, len(keys) == 2 && keys[0] == "users/2", "wrong inclusive age range: %v", keys)
+
+	// writes keep the entries up to date
+	assert(t, app.batch(oplist{
+		{Op: "put", Key: "users/1", Value: `{"email": "c@example.com", "age": 30}`},
+	}), "batch failed")
+	app.del("users/2")
+
+	keys = lookup("email?value=a@example.com")
+	assert(t, len(keys) == 0, "stale email entry: %v", keys)
+	keys = lookup("email?value=c@example.com")
+	assert(t, len(keys) == 1 && keys[0] == "users/1", "missing updated email entry: %v", keys)
+	keys = lookup("age?start=0")
+	assert(t, len(keys) == 1 && keys[0] == "users/1", "stale age entry: %v", keys)
+
+	// the entries themselves stay out of sight
+	rr = app.doReq("GET", "http://domain/iterate?include_values=no", "")
+	body := &struct{ Data []string }{}
+	if err := json.NewDecoder(rr.Body).Decode(body); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(body.Data) == 2, "internal keys visible in /iterate: %q", body.Data)
+
+	// only indexes over keys the client may read are listed
+	tokens = map[string]role{"t": roleRead}
+	acl = map[string][]aclRule{"token:t": {{aclRead, []byte("other/")}}}
+	listed := func() string {
+		req, _ := http.NewRequest("GET", "http://domain/indexes", nil)
+		req.Header.Set("Authorization", "Bearer t")
+		rr := httptest.NewRecorder()
+		app.app.ServeHTTP(rr, req)
+		assert(t, rr.Code == 200, "bad GET /indexes response: %d", rr.Code)
+		return rr.Body.String()
+	}
+	assert(t, strings.TrimSpace(listed()) == "[]", "indexes listed under an ACL not covering them: %s", listed())
+	acl["token:t"] = append(acl["token:t"], aclRule{aclRead, []byte("users/2")})
+	assert(t, strings.Count(listed(), `"name"`) == 2, "indexes over partly readable keys not listed: %s", listed())
+	tokens, acl = nil, nil
+
+	rr = app.doReq("DELETE", "http://domain/index/age", "")
+	assert(t, rr.Code == 204, "bad DELETE /index/age response: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/index/age?start=0", "")
+	assert(t, rr.Code == 404, "dropped index still queryable: %d", rr.Code)
+}
+
+func TestIndexValueOrder(t *testing.T) {
+	ordered := []interface{}{nil, false, true, -1e10, -2.5, 0.0, 1.0, 10.0, "", "a", "a\x00", "ab", "b"}
+	var prev []byte
+	for _, v := range ordered {
+		enc, ok := encodeIndexValue(v)
+		assert(t, ok, "failed to encode %#v", v)
+		assert(t, bytes.Compare(prev, enc) < 0, "%#v sorts out of order", v)
+
+		dec, n, err := decodeIndexValue(append(enc, "key"...))
+		assert(t, err == nil && n == len(enc) && dec == v, "%#v decoded as %#v (%d bytes, %v)", v, dec, n, err)
+		prev = enc
+	}
+}
+
+func TestPatch(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("doc", `{"a": 1, "b": {"c": 2}}`)
+	app.put("text", "not json")
+
+	rr := app.doReq("PATCH", "http://domain/key/doc", `{"a": null, "b": {"d": 3}}`)
+	assert(t, rr.Code == 200, "bad merge PATCH response: %d", rr.Code)
+	assert(t, rr.Body.String() == `{"b":{"c":2,"d":3}}`, "wrong merge-patched document: %s", rr.Body.String())
+
+	rr = app.doReq("PATCH", "http://domain/key/doc", `[{"op": "add", "path": "/b/e", "value": [1]}, {"op": "move", "from": "/b/c", "path": "/b/e/0"}]`)
+	assert(t, rr.Code == 200, "bad JSON PATCH response: %d", rr.Code)
+	assert(t, app.get("doc") == `{"b":{"d":3,"e":[2,1]}}`, "wrong JSON-patched document: %s", app.get("doc"))
+
+	rr = app.doReq("PATCH", "http://domain/key/doc", `[{"op": "test", "path": "/b/d", "value": 4}]`)
+	assert(t, rr.Code == 409, "wrong code for a failed test op: %d", rr.Code)
+	rr = app.doReq("PATCH", "http://domain/key/doc", `[{"op": "test", "path": "/b/d", "value": 3.0}]`)
+	assert(t, rr.Code == 200, "test op didn't match an equal number: %d", rr.Code)
+
+	// numbers are compared exactly, even past what a float64 holds
+	app.put("big", `{"n": 9007199254740992}`)
+	rr = app.doReq("PATCH", "http://domain/key/big", `[{"op": "test", "path": "/n", "value": 9007199254740993}]`)
+	assert(t, rr.Code == 409, "test op matched a different big integer: %d", rr.Code)
+	rr = app.doReq("PATCH", "http://domain/key/big", `[{"op": "test", "path": "/n", "value": 9007199254740992}]`)
+	assert(t, rr.Code == 200, "test op didn't match the same big integer: %d", rr.Code)
+
+	// trailing data after the patch is rejected, closing brackets included
+	for _, body := range []string{`{"a": 1}]`, `{"a": 1}}`, `{"a": 1} {}`} {
+		rr = app.doReq("PATCH", "http://domain/key/doc", body)
+		assert(t, rr.Code == 400, "wrong code for a patch with trailing data %s: %d", body, rr.Code)
+	}
+
+	rr = app.doReq("PATCH", "http://domain/key/text", `{"a": 1}`)
+	assert(t, rr.Code == 409, "wrong code for patching a non-JSON value: %d", rr.Code)
+	assert(t, app.get("text") == "not json", "non-JSON value was changed")
+
+	// a missing key is only created when asked for
+	rr = app.doReq("PATCH", "http://domain/key/missing", `{"a": 1}`)
+	assert(t, rr.Code == 404, "wrong code for patching a missing key: %d", rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), `"not_found"`), "wrong error for patching a missing key: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/key/missing", "")
+	assert(t, rr.Code == 404, "PATCH of a missing key created it: %d", rr.Code)
+	rr = app.doReq("PATCH", "http://domain/key/missing?upsert=yes", `{"a": 1}`)
+	assert(t, rr.Code == 200, "bad upsert PATCH response: %d", rr.Code)
+	assert(t, app.get("missing") == `{"a":1}`, "wrong upserted document: %s", app.get("missing"))
+
+	assert(t, app.batch(oplist{
+		{"patch", "doc", `{"b": null}`},
+		{"patch", "new", `[{"op": "add", "path": "", "value": {"x": true}}]`},
+	}), "batch with patch ops failed")
+	assert(t, app.get("doc") == `{}`, "wrong batch-patched document: %s", app.get("doc"))
+	assert(t, app.get("new") == `{"x":true}`, "wrong batch-patched new key: %s", app.get("new"))
+}
+
+func TestValueMeta(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("plain", "P")
+
+	req, err := http.NewRequest("PUT", "http://domain/key/pic", strings.NewReader("PNG data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("X-Ldb-Meta-Owner", "alice")
+	rr := httptest.NewRecorder()
+	app.app.ServeHTTP(rr, req)
+	assert(t, rr.Code == 204, "bad PUT with metadata response: %d", rr.Code)
+
+	rr = app.doReq("GET", "http://domain/key/pic", "")
+	assert(t, rr.Code == 200, "bad GET response: %d", rr.Code)
+	assert(t, rr.HeaderMap.Get("Content-Type") == "image/png", "wrong Content-Type: %s", rr.HeaderMap.Get("Content-Type"))
+	assert(t, rr.HeaderMap.Get("X-Ldb-Meta-Owner") == "alice", "wrong metadata: %v", rr.HeaderMap)
+	assert(t, rr.Body.String() == "PNG data", "wrong value: %q", rr.Body.String())
+
+	// values with nothing to go in a header are stored raw, and come back
+	// as they were, even ones that look like they have a header
+	stored, err := db.Get(ro, []byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, string(stored) == "P", "plain value wasn't stored raw: %q", stored)
+	assert(t, app.get("plain") == "P", "wrong raw value")
+	assert(t, app.batch(oplist{{"put", "tricky", valueMagic + "x"}}), "batch failed")
+	assert(t, app.get("tricky") == valueMagic+"x", "wrong value with the magic prefix: %q", app.get("tricky"))
+
+	rr = app.doReq("GET", "http://domain/iterate?include_meta=yes&start=pic&end=plain&include_end=yes", "")
+	body := &struct {
+		Data []struct {
+			Key, Value  string
+			ContentType string `json:"content_type"`
+			Meta        map[string]string
+		}
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(body); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(body.Data) == 2, "wrong number of items from /iterate: %d", len(body.Data))
+	pic := body.Data[0]
+	assert(t, pic.Value == "PNG data" && pic.ContentType == "image/png" && pic.Meta["owner"] == "alice",
+		"wrong /iterate metadata: %+v", pic)
+	assert(t, body.Data[1].ContentType == "", "raw value with metadata in /iterate: %+v", body.Data[1])
+}
+
+func TestConditionalGet(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("untracked", "hello")
+	rr := app.doReq("HEAD", "http://domain/key/untracked", "")
+	assert(t, rr.HeaderMap.Get("ETag") != "", "missing ETag")
+	assert(t, rr.HeaderMap.Get("Last-Modified") == "", "Last-Modified without -last-modified: %v", rr.HeaderMap)
+
+	SetTrackModified(true)
+	defer SetTrackModified(false)
+	app.put("a", "hello")
+
+	withHeader := func(method, name, value string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://domain/key/a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "" {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		app.app.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr = withHeader("HEAD", "", "")
+	assert(t, rr.Code == 200, "bad HEAD response: %d", rr.Code)
+	assert(t, rr.Body.Len() == 0, "HEAD response has a body: %q", rr.Body.String())
+	assert(t, rr.HeaderMap.Get("Content-Length") == "5", "wrong HEAD Content-Length: %s", rr.HeaderMap.Get("Content-Length"))
+	etag := rr.HeaderMap.Get("ETag")
+	modified := rr.HeaderMap.Get("Last-Modified")
+	assert(t, etag != "" && modified != "", "missing validators: %v", rr.HeaderMap)
+
+	rr = withHeader("GET", "If-None-Match", etag)
+	assert(t, rr.Code == 304, "wrong code for a matching If-None-Match: %d", rr.Code)
+	rr = withHeader("GET", "If-Modified-Since", modified)
+	assert(t, rr.Code == 304, "wrong code for If-Modified-Since: %d", rr.Code)
+
+	app.put("a", "hello")
+	rr = withHeader("GET", "If-None-Match", etag)
+	assert(t, rr.Code == 200, "wrong code for a stale If-None-Match: %d", rr.Code)
+	assert(t, rr.Body.String() == "hello", "wrong value: %q", rr.Body.String())
+
+	rr = app.doReq("HEAD", "http://domain/key/missing", "")
+	assert(t, rr.Code == 404, "wrong code for HEAD of a missing key: %d", rr.Code)
+}
+
+func TestChunkedValues(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	big := make([]byte, 2*valueChunkSize+500)
+	for i := range big {
+		big[i] = byte('a' + i%26)
+	}
+	app.put("big", string(big))
+
+	countChunks := func() int {
+		var n int
+		it := db.NewIterator(ro)
+		defer it.Close()
+		prefix := internalKey("chunk/")
+		for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+			n++
+		}
+		return n
+	}
+	assert(t, countChunks() == 3, "wrong number of chunks: %d", countChunks())
+
+	assert(t, app.get("big") == string(big), "chunked value didn't come back whole")
+
+	req, err := http.NewRequest("GET", "http://domain/key/big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", valueChunkSize-5, valueChunkSize+4))
+	rr := httptest.NewRecorder()
+	app.app.ServeHTTP(rr, req)
+	assert(t, rr.Code == 206, "bad Range GET response: %d", rr.Code)
+	want := string(big[valueChunkSize-5 : valueChunkSize+5])
+	assert(t, rr.Body.String() == want, "wrong range across chunks: %q (wanted %q)", rr.Body.String(), want)
+
+	rr = app.doReq("POST", "http://domain/keys", `{"keys": ["big"]}`)
+	results := map[string]string{}
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, results["big"] == string(big), "chunked value didn't come back whole from /keys")
+
+	// replacing the value cleans up its chunks
+	app.put("big", "small")
+	assert(t, countChunks() == 0, "chunks left behind: %d", countChunks())
+	assert(t, app.get("big") == "small", "wrong replaced value")
+}
+
+func TestInterruptedUpload(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+
+	countKeys := func(name string) int {
+		var n int
+		it := db.NewIterator(ro)
+		defer it.Close()
+		prefix := internalKey(name)
+		for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+			n++
+		}
+		return n
+	}
+
+	// big enough that some chunks are written before the header
+	big := strings.Repeat("x", (chunksPerWrite+1)*valueChunkSize+1)
+	app.put("big", big)
+	assert(t, countKeys("chunk/") == chunksPerWrite+2, "wrong number of chunks: %d", countKeys("chunk/"))
+	assert(t, countKeys("upload/") == 0, "upload marker left behind")
+
+	// as left by a crash partway through an upload
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	wb.Put(uploadKey("cutoff"), nil)
+	wb.Put(chunkKey("cutoff", 0), []byte("partial"))
+	wb.Put(chunkKey("cutoff", 1), []byte("partial"))
+	if err := db.Write(wo, wb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sweepUploads(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, countKeys("chunk/cutoff/") == 0, "interrupted upload's chunks weren't swept")
+	assert(t, countKeys("upload/") == 0, "interrupted upload's marker wasn't swept")
+	assert(t, countKeys("chunk/") == chunksPerWrite+2, "finished upload's chunks were swept")
+	assert(t, app.get("big") == big, "chunked value damaged by the sweep")
+}
+
+func TestCompression(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	if err := SetCompression([]CompressRule{{"z/", "gzip"}, {"z/raw/", "none"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetCompression(nil)
+
+	app := newAppTester(t)
+	value := strings.Repeat(`{"field": "value"}`, 100)
+	app.put("z/doc", value)
+	app.put("z/raw/doc", value)
+
+	stored, err := db.Get(ro, []byte("z/doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(stored) < len(value)/2, "value wasn't stored compressed (%d bytes)", len(stored))
+	stored, err = db.Get(ro, []byte("z/raw/doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, string(stored) == value, "exempt value wasn't stored as-is (%d bytes)", len(stored))
+
+	// decompressed for clients that don't accept gzip...
+	assert(t, app.get("z/doc") == value, "wrong decompressed value")
+
+	// ...and passed through for those that do
+	get := func(url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		app.app.ServeHTTP(rr, req)
+		return rr
+	}
+	gunzip := func(rr *httptest.ResponseRecorder) string {
+		assert(t, rr.HeaderMap.Get("Content-Encoding") == "gzip", "response wasn't gzipped: %v", rr.HeaderMap)
+		zr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	rr := get("http://domain/key/z/doc")
+	assert(t, rr.Code == 200, "bad GET response: %d", rr.Code)
+	assert(t, gunzip(rr) == value, "wrong passed-through value")
+
+	rr = get("http://domain/iterate?start=z/&end=z0")
+	body := &struct{ Data []struct{ Key, Value string } }{}
+	if err := json.Unmarshal([]byte(gunzip(rr)), body); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(body.Data) == 2 && body.Data[0].Value == value, "wrong /iterate values: %+v", body.Data)
+
+	// batch writes are compressed too, and patches see through it
+	assert(t, app.batch(oplist{{"put", "z/b", `{"a": "` + strings.Repeat("x", 200) + `"}`}}), "batch failed")
+	rr = app.doReq("PATCH", "http://domain/key/z/b", `{"b": 1}`)
+	assert(t, rr.Code == 200, "bad PATCH of a compressed value: %d", rr.Code)
+	assert(t, strings.HasSuffix(app.get("z/b"), `"b":1}`), "wrong patched value: %s", app.get("z/b"))
+}
+
+func TestTxn(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.put("balance/a", "10")
+	app.put("balance/b", "0")
+
+	begin := func() string {
+		rr := app.doReq("POST", "http://domain/txn", "")
+		assert(t, rr.Code == 201, "bad POST /txn response: %d", rr.Code)
+		txn := &struct{ ID string }{}
+		if err := json.Unmarshal(rr.Body.Bytes(), txn); err != nil {
+			t.Fatal(err)
+		}
+		return "http://domain/txn/" + txn.ID
+	}
+
+	// reads see the snapshot and the transaction's own writes
+	txn := begin()
+	rr := app.doReq("GET", txn+"/key/balance/a", "")
+	assert(t, rr.Code == 200 && rr.Body.String() == "10", "bad txn read: %d %s", rr.Code, rr.Body.String())
+	rr = app.doReq("PUT", txn+"/key/balance/a", "7")
+	assert(t, rr.Code == 204, "bad txn PUT response: %d", rr.Code)
+	rr = app.doReq("PUT", txn+"/key/balance/b", "3")
+	assert(t, rr.Code == 204, "bad txn PUT response: %d", rr.Code)
+	rr = app.doReq("GET", txn+"/key/balance/a", "")
+	assert(t, rr.Body.String() == "7", "txn read didn't see its own write: %s", rr.Body.String())
+	assert(t, app.get("balance/a") == "10", "txn write was visible before commit")
+
+	rr = app.doReq("POST", txn+"/commit", "")
+	assert(t, rr.Code == 204, "bad commit response: %d", rr.Code)
+	assert(t, app.get("balance/a") == "7" && app.get("balance/b") == "3", "commit didn't apply the writes")
+	rr = app.doReq("GET", txn+"/key/balance/a", "")
+	assert(t, rr.Code == 404, "transaction still usable after commit: %d", rr.Code)
+
+	// a key read by the transaction changing underneath it is a conflict
+	txn = begin()
+	app.put("balance/a", "8")
+	rr = app.doReq("GET", txn+"/key/balance/a", "")
+	assert(t, rr.Body.String() == "7", "txn read saw a write made after it began: %s", rr.Body.String())
+	app.doReq("DELETE", txn+"/key/balance/b", "")
+	rr = app.doReq("POST", txn+"/commit", "")
+	assert(t, rr.Code == 409, "wrong code for a conflicting commit: %d", rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "txn_conflict"), "wrong conflict body: %s", rr.Body.String())
+	assert(t, app.get("balance/b") == "3", "conflicting transaction's delete was applied")
+
+	// but keys it only wrote don't count
+	txn = begin()
+	app.doReq("PUT", txn+"/key/balance/b", "4")
+	app.put("balance/b", "9")
+	rr = app.doReq("POST", txn+"/commit", "")
+	assert(t, rr.Code == 204, "blind write conflicted: %d", rr.Code)
+	assert(t, app.get("balance/b") == "4", "blind write wasn't applied")
+
+	// nor does the same value being written again, even with a new time
+	SetTrackModified(true)
+	txn = begin()
+	app.doReq("GET", txn+"/key/balance/b", "")
+	app.doReq("PUT", txn+"/key/balance/a", "5")
+	time.Sleep(time.Millisecond)
+	app.put("balance/b", "4")
+	rr = app.doReq("POST", txn+"/commit", "")
+	SetTrackModified(false)
+	assert(t, rr.Code == 204, "rewriting the same value conflicted: %d %s", rr.Code, rr.Body.String())
+
+	// large values are stored in chunks as with PUT /key
+	big := strings.Repeat("x", valueChunkSize+1)
+	txn = begin()
+	app.doReq("PUT", txn+"/key/big", big)
+	rr = app.doReq("POST", txn+"/commit", "")
+	assert(t, rr.Code == 204, "bad commit response: %d", rr.Code)
+	stored, err := db.Get(ro, []byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := decodeValue(stored)
+	assert(t, h.Chunks != nil && h.Chunks.Size == int64(len(big)), "big txn write wasn't chunked: %+v", h)
+	assert(t, app.get("big") == big, "wrong chunked txn value")
+
+	txn = begin()
+	rr = app.doReq("DELETE", txn, "")
+	assert(t, rr.Code == 204, "bad abort response: %d", rr.Code)
+	rr = app.doReq("POST", txn+"/commit", "")
+	assert(t, rr.Code == 404, "aborted transaction committed: %d", rr.Code)
+
+	// unused transactions expire
+	SetTxnTimeout(10 * time.Millisecond)
+	defer SetTxnTimeout(30 * time.Second)
+	txn = begin()
+	time.Sleep(50 * time.Millisecond)
+	rr = app.doReq("GET", txn+"/key/balance/a", "")
+	assert(t, rr.Code == 404, "transaction didn't expire: %d", rr.Code)
+	txns.Lock()
+	assert(t, len(txns.open) == 0, "%d transactions left open", len(txns.open))
+	txns.Unlock()
+}
+
+func TestTxnBucketAndTupleKeys(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	app.doReq("PUT", "http://domain/b/users", "")
+	app.doReq("PUT", "http://domain/b/users/key/a", "A")
+
+	rr := app.doReq("POST", "http://domain/txn", "")
+	txn := &struct{ ID string }{}
+	if err := json.Unmarshal(rr.Body.Bytes(), txn); err != nil {
+		t.Fatal(err)
+	}
+	base := "http://domain/txn/" + txn.ID
+	tuple := url.PathEscape(`["user", 1]`)
+
+	rr = app.doReq("GET", base+"/b/users/key/a", "")
+	assert(t, rr.Code == 200 && rr.Body.String() == "A", "bad txn bucket read: %d %s", rr.Code, rr.Body.String())
+	rr = app.doReq("PUT", base+"/b/users/key/b", "B")
+	assert(t, rr.Code == 204, "bad txn bucket PUT response: %d", rr.Code)
+	rr = app.doReq("DELETE", base+"/b/users/key/a", "")
+	assert(t, rr.Code == 204, "bad txn bucket DELETE response: %d", rr.Code)
+	rr = app.doReq("PUT", base+"/b/missing/key/a", "A")
+	assert(t, rr.Code == 404 && strings.Contains(rr.Body.String(), "no_bucket"), "wrong txn PUT to a missing bucket: %d %s", rr.Code, rr.Body.String())
+	rr = app.doReq("PUT", base+"/key/"+tuple+"?key_format=tuple", "T")
+	assert(t, rr.Code == 204, "bad txn tuple PUT response: %d", rr.Code)
+	rr = app.doReq("PUT", base+"/b/users/key/"+tuple+"?key_format=tuple", "BT")
+	assert(t, rr.Code == 204, "bad txn bucket tuple PUT response: %d", rr.Code)
+	rr = app.doReq("GET", base+"/key/"+tuple+"?key_format=tuple", "")
+	assert(t, rr.Body.String() == "T", "txn tuple read didn't see its own write: %s", rr.Body.String())
+	rr = app.doReq("PUT", base+"/key/notatuple?key_format=tuple", "x")
+	assert(t, rr.Code == 400, "wrong code for a bad txn tuple key: %d", rr.Code)
+
+	rr = app.doReq("POST", base+"/commit", "")
+	assert(t, rr.Code == 204, "bad commit response: %d", rr.Code)
+
+	found, _ := app.maybeGet("b")
+	assert(t, !found, "txn bucket write landed at the top level")
+	rr = app.doReq("GET", "http://domain/b/users/key/b", "")
+	assert(t, rr.Body.String() == "B", "txn bucket write wasn't applied: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/b/users/key/a", "")
+	assert(t, rr.Code == 404, "txn bucket delete wasn't applied: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/key/"+tuple+"?key_format=tuple", "")
+	assert(t, rr.Body.String() == "T", "txn tuple write wasn't applied: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/b/users/key/"+tuple+"?key_format=tuple", "")
+	assert(t, rr.Body.String() == "BT", "txn bucket tuple write wasn't applied: %s", rr.Body.String())
+}
+
+func TestBuckets(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	rr := app.doReq("PUT", "http://domain/b/users/key/a", "A")
+	assert(t, rr.Code == 404, "wrong code for PUT to a missing bucket: %d", rr.Code)
+	rr = app.doReq("PUT", "http://domain/b/users", "")
+	assert(t, rr.Code == 201, "bad bucket create response: %d", rr.Code)
+	rr = app.doReq("PUT", "http://domain/b/users", "")
+	assert(t, rr.Code == 200, "bad bucket re-create response: %d", rr.Code)
+	rr = app.doReq("PUT", "http://domain/b/bad%20name", "")
+	assert(t, rr.Code == 400, "wrong code for an invalid bucket name: %d", rr.Code)
+	app.doReq("PUT", "http://domain/b/users.archive", "")
+
+	// bucket keys are separate from top-level keys and other buckets'
+	app.put("users:a", "top")
+	for _, key := range []string{"a", "a:b", "b", "c/"} {
+		rr = app.doReq("PUT", "http://domain/b/users/key/"+key, "in "+key)
+		assert(t, rr.Code == 204, "bad bucket PUT response: %d", rr.Code)
+	}
+	app.doReq("PUT", "http://domain/b/users.archive/key/z", "Z")
+
+	rr = app.doReq("GET", "http://domain/b/users/key/a:b", "")
+	assert(t, rr.Code == 200 && rr.Body.String() == "in a:b", "bad bucket GET: %d %s", rr.Code, rr.Body.String())
+	assert(t, app.get("users:a") == "top", "top-level key was clobbered")
+	found, _ := app.maybeGet("a")
+	assert(t, !found, "bucket key visible at the top level")
+
+	rr = app.doReq("GET", "http://domain/iterate?include_values=no", "")
+	assert(t, rr.Body.String() == `{"more":false,"data":["users:a"]}`+"\n", "top-level iterate saw bucket keys: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/b/users/iterate?include_values=no", "")
+	assert(t, rr.Body.String() == `{"more":false,"data":["a","a:b","b","c/"]}`+"\n", "wrong bucket iterate: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/b/users/iterate?include_values=no&forward=no&start=b&max=2", "")
+	assert(t, rr.Body.String() == `{"more":true,"data":["b","a:b"],"last":"a:b"}`+"\n", "wrong backwards bucket iterate: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/b/users/iterate?include_values=no&forward=no&start=zz", "")
+	assert(t, rr.Body.String() == `{"more":false,"data":["c/","b","a:b","a"]}`+"\n", "backwards bucket iterate from a missing key left the bucket: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/b/users/iterate?start=a:&end=c", "")
+	assert(t, rr.Body.String() == `{"more":false,"data":[{"key":"a:b","value":"in a:b"},{"key":"b","value":"in b"}]}`+"\n", "wrong bounded bucket iterate: %s", rr.Body.String())
+
+	rr = app.doReq("GET", "http://domain/b/users/stats", "")
+	stats := &struct{ Keys, Size int }{}
+	json.Unmarshal(rr.Body.Bytes(), stats)
+	assert(t, rr.Code == 200 && stats.Keys == 4 && stats.Size == 26, "wrong bucket stats: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/buckets", "")
+	assert(t, strings.Count(rr.Body.String(), `"name"`) == 2, "wrong bucket list: %s", rr.Body.String())
+
+	// a bucket's keys can be scoped by the ACL like top-level ones
+	tokens = map[string]role{"t": roleWrite}
+	acl = map[string][]aclRule{"token:t": {{aclRead, append(aclBucketPrefix("users"), "a"...)}}}
+	authReq := func(method, url string) int {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer t")
+		rr := httptest.NewRecorder()
+		app.app.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert(t, authReq("GET", "http://domain/b/users/key/a:b") == 200, "ACL refused a bucket key it allows")
+	assert(t, authReq("GET", "http://domain/b/users/key/b") == 403, "ACL allowed a bucket key it doesn't cover")
+	assert(t, authReq("GET", "http://domain/b/users.archive/key/a") == 403, "ACL allowed another bucket's key")
+	assert(t, authReq("GET", "http://domain/key/a") == 403, "ACL allowed a top-level key by a bucket rule")
+
+	// and another bucket's stats, or that it exists, are hidden too
+	assert(t, authReq("GET", "http://domain/b/users/stats") == 200, "ACL refused stats of its bucket")
+	assert(t, authReq("GET", "http://domain/b/users.archive/stats") == 403, "ACL allowed another bucket's stats")
+	assert(t, authReq("GET", "http://domain/b/missing/stats") == 403, "ACL revealed a bucket doesn't exist")
+	req, _ := http.NewRequest("GET", "http://domain/buckets", nil)
+	req.Header.Set("Authorization", "Bearer t")
+	rr = httptest.NewRecorder()
+	app.app.ServeHTTP(rr, req)
+	assert(t, strings.Count(rr.Body.String(), `"name"`) == 1 && strings.Contains(rr.Body.String(), `"users"`), "wrong bucket list under the ACL: %s", rr.Body.String())
+	tokens, acl = nil, nil
+
+	// dropping a bucket deletes its keys (a new one by the same name is empty)
+	rr = app.doReq("DELETE", "http://domain/b/users", "")
+	assert(t, rr.Code == 204, "bad bucket drop response: %d", rr.Code)
+	rr = app.doReq("GET", "http://domain/b/users/key/a", "")
+	assert(t, rr.Code == 404, "wrong code for GET in a dropped bucket: %d", rr.Code)
+	app.doReq("PUT", "http://domain/b/users", "")
+	rr = app.doReq("GET", "http://domain/b/users/iterate", "")
+	assert(t, rr.Body.String() == `{"more":false,"data":[]}`+"\n", "recreated bucket isn't empty: %s", rr.Body.String())
+	rr = app.doReq("GET", "http://domain/b/users.archive/key/z", "")
+	assert(t, rr.Body.String() == "Z", "dropping a bucket touched another: %s", rr.Body.String())
+}
+
+func TestTupleOrder(t *testing.T) {
+	// in sorted order
+	tuples := []string{
+		`[]`,
+		`[null]`,
+		`["a"]`,
+		`["a", null]`,
+		`["a", "1"]`,
+		`["a", "2024-01-01T00:00:00Z"]`,
+		`["a", ["b", null]]`,
+		`["a", ["b", null, 1]]`,
+		`["a", ["b", 1]]`,
+		`["a", -100000000000000000000000]`,
+		`["a", -9223372036854775809]`,
+		`["a", -9223372036854775808]`,
+		`["a", -70000]`,
+		`["a", -256]`,
+		`["a", -1]`,
+		`["a", 0]`,
+		`["a", 1]`,
+		`["a", 255]`,
+		`["a", 256]`,
+		`["a", 9223372036854775807]`,
+		`["a", 9223372036854775808]`,
+		`["a", 100000000000000000000000]`,
+		// floats are a type of their own, after the integers
+		`["a", -0.5]`,
+		`["a", 1.5]`,
+		`["a", 2.0]`,
+		`["a", 1e100]`,
+		`["a", false]`,
+		`["a", true]`,
+		`["a", {"$time": "1969-12-31T23:59:59Z"}]`,
+		`["a", {"$time": "2024-01-01T00:00:00Z"}]`,
+		`["a", {"$time": "2024-01-01T01:00:00.5+01:00"}]`,
+		`["a", {"$time": "2024-01-01T00:00:01Z"}]`,
+		`["a\u0000"]`,
+		`["a\u0000", 1]`,
+		`["ab"]`,
+	}
+
+	var prev []byte
+	for i, s := range tuples {
+		key, err := parseTupleKey([]byte(s))
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if i > 0 {
+			assert(t, bytes.Compare(prev, key) < 0, "%s doesn't sort after %s", s, tuples[i-1])
+		}
+		prev = key
+
+		tuple, err := decodeTuple(key)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		b, err := json.Marshal(tuple)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := parseTupleKey(b)
+		assert(t, err == nil && bytes.Equal(again, key), "%s didn't survive decoding (as %s)", s, b)
+	}
+
+	_, err := parseTupleKey([]byte(`{"a": 1}`))
+	assert(t, err != nil, "parsed a non-array tuple")
+	_, err = parseTupleKey([]byte(`[{"a": 1}]`))
+	assert(t, err != nil, "parsed a tuple with an object in it")
+	_, err = parseTupleKey([]byte(`[{"$time": "yesterday"}]`))
+	assert(t, err != nil, "parsed a tuple with a bad time in it")
+
+	// strings that look like times are still strings
+	key, _ := parseTupleKey([]byte(`["2024-01-01T00:00:00+01:00"]`))
+	tuple, err := decodeTuple(key)
+	assert(t, err == nil && len(tuple) == 1 && tuple[0] == "2024-01-01T00:00:00+01:00", "time-like string didn't round-trip: %v", tuple)
+
+	// and integers past int64 keep every digit
+	key, _ = parseTupleKey([]byte(`[123456789012345678901234567890]`))
+	tuple, err = decodeTuple(key)
+	assert(t, err == nil && len(tuple) == 1 && tuple[0] == json.Number("123456789012345678901234567890"), "big integer didn't round-trip: %v", tuple)
+}
+
+func TestTupleKeys(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+
+	app := newAppTester(t)
+	keyURL := func(tuple string) string {
+		return "http://domain/key/" + url.PathEscape(tuple) + "?key_format=tuple"
+	}
+	for _, n := range []string{"9", "10", "100", "-5"} {
+		rr := app.doReq("PUT", keyURL(`["user", `+n+`]`), "u"+n)
+		assert(t, rr.Code == 204, "bad tuple PUT response: %d", rr.Code)
+	}
+	rr := app.doReq("GET", keyURL(`["user", 10]`), "")
+	assert(t, rr.Code == 200 && rr.Body.String() == "u10", "bad tuple GET: %d %s", rr.Code, rr.Body.String())
+	rr = app.doReq("GET", keyURL(`"user"`), "")
+	assert(t, rr.Code == 400, "wrong code for a non-tuple key: %d", rr.Code)
+
+	rr = app.doReq("POST", "http://domain/batch?key_format=tuple", `{"ops": [
+		{"op": "put", "key": ["event", {"$time": "2024-01-02T00:00:00Z"}], "value": "e2"},
+		{"op": "put", "key": ["event", {"$time": "2024-01-01T12:00:00-11:00"}], "value": "e3"},
+		{"op": "put", "key": ["event", {"$time": "2024-01-01T00:00:00Z"}], "value": "e1"}
+	]}`)
+	assert(t, rr.Code == 204, "bad tuple batch response: %d", rr.Code)
+	rr = app.doReq("POST", "http://domain/batch?key_format=tuple", `{"ops": [{"op": "delete", "key": "event"}]}`)
+	assert(t, rr.Code == 400 && strings.Contains(rr.Body.String(), `"op_index":0`), "bad response to a non-tuple batch key: %d %s", rr.Code, rr.Body.String())
+
+	iterate := func(query string) string {
+		rr := app.doReq("GET", "http://domain/iterate?key_format=tuple&"+query, "")
+		assert(t, rr.Code == 200, "bad tuple iterate response: %d", rr.Code)
+		return rr.Body.String()
+	}
+	body := iterate("include_values=no&start=" + url.QueryEscape(`["user", 0]`) + "&end=" + url.QueryEscape(`["user", 100]`))
+	assert(t, body == `{"more":false,"data":[["user",9],["user",10]]}`+"\n", "wrong integer range: %s", body)
+	body = iterate("start=" + url.QueryEscape(`["event"]`) + "&end=" + url.QueryEscape(`["event", {"$time": "2024-01-02T00:00:00Z"}]`))
+	assert(t, body == `{"more":false,"data":[`+
+		`{"key":["event",{"$time":"2024-01-01T00:00:00Z"}],"value":"e1"},`+
+		`{"key":["event",{"$time":"2024-01-01T23:00:00Z"}],"value":"e3"}]}`+"\n", "wrong time range: %s", body)
+
+	// a stored key with a float JSON can't show isn't read as a tuple
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		bits := math.Float64bits(f)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		key := make([]byte, 9)
+		key[0] = tupleDouble
+		binary.BigEndian.PutUint64(key[1:], bits)
+		_, err := decodeTuple(key)
+		assert(t, err == errBadTuple, "decoded a tuple with %v in it", f)
+		app.put(url.PathEscape(string(key)), "x")
+	}
+	rr = app.doReq("GET", "http://domain/iterate?key_format=tuple&include_values=no&start="+url.QueryEscape(`[1.5]`), "")
+	resp := &struct{ Data []interface{} }{}
+	err := json.Unmarshal(rr.Body.Bytes(), resp)
+	assert(t, rr.Code == 200 && err == nil && len(resp.Data) == 2, "bad tuple iterate over non-finite floats: %d %s", rr.Code, rr.Body.String())
+	for _, key := range resp.Data {
+		_, isString := key.(string)
+		assert(t, isString, "non-finite float key shown as a tuple: %v", key)
+	}
+}
+
+func TestComparators(t *testing.T) {
+	// in sorted order
+	sorted := map[string][]string{
+		"bytewise":         {"", "A", "B", "a", "x10", "x9"},
+		"reverse-bytewise": {"x9", "x10", "a", "B", "A", ""},
+		"numeric-aware":    {"", "x2", "x09", "x9", "x10", "x10a", "xa"},
+		"case-insensitive": {"", "A", "a", "ab", "B", "b"},
+	}
+	for name, keys := range sorted {
+		c := comparators[name]
+		for i := range keys {
+			for j := range keys {
+				cmp := c.order([]byte(keys[i]), []byte(keys[j]))
+				want := 0
+				if i < j {
+					want = -1
+				} else if i > j {
+					want = 1
+				}
+				assert(t, cmp == want, "%s compared %q to %q as %d", name, keys[i], keys[j], cmp)
+			}
+		}
+	}
+
+	// the internal keyspace comes last and bytewise, but for bucket keys
+	c := comparators["reverse-bytewise"]
+	def := &bucketDef{ID: strings.Repeat("0", bucketIDLen)}
+	assert(t, c.order([]byte("\xff"), internalKey("idx/")) < 0, "internal key sorted before a client key")
+	assert(t, c.order(internalKey("a"), internalKey("b")) < 0, "internal keys aren't bytewise")
+	assert(t, c.order(def.key([]byte("a")), def.key([]byte("b"))) > 0, "bucket keys aren't in comparator order")
+	assert(t, c.order(def.floor(), def.key(nil)) < 0, "bucket floor isn't before its keys")
+	assert(t, c.order(def.key(nil), prefixEnd(def.prefix())) < 0, "bucket keys run past the prefix's end")
+}
+
+func TestComparatorMarker(t *testing.T) {
+	dbpath := setup(t)
+	defer cleanup(dbpath)
+	defer func() { keyOrder = comparators["bytewise"] }()
+
+	// a database from before the marker is bytewise
+	assert(t, checkComparator(dbpath) == nil, "unmarked db refused as bytewise")
+	keyOrder = comparators["reverse-bytewise"]
+	assert(t, checkComparator(dbpath) != nil, "unmarked db accepted as reverse-bytewise")
+	assert(t, checkComparator(dbpath+"_new") == nil, "new db refused")
+	keyOrder = comparators["bytewise"]
+
+	// snapshots are marked, and restoring one with the wrong comparator fails
+	app := newAppTester(t)
+	app.put("a", "A")
+	dest := dbpath + "_snap"
+	defer os.RemoveAll(dest)
+	rr := app.doReq("POST", "http://domain/snapshot", fmt.Sprintf(`{"destination": %q}`, dest))
+	assert(t, rr.Code == 204, "bad POST /snapshot response: %d", rr.Code)
+	b, err := ioutil.ReadFile(filepath.Join(dest, comparatorFile))
+	assert(t, err == nil && string(b) == "bytewise\n", "bad snapshot marker: %q %v", b, err)
+
+	keyOrder = comparators["numeric-aware"]
+	rr = app.doReq("POST", "http://domain/restore", fmt.Sprintf(`{"source": %q}`, dest))
+	assert(t, rr.Code == 400, "wrong code restoring a mismatched snapshot: %d", rr.Code)
+}
+
 func setup(tb testing.TB) string {
 	dirpath, err := ioutil.TempDir("", "ldbrest_test")
 	if err != nil {
@@ -183,6 +1602,7 @@ func setup(tb testing.TB) string {
 
 	opts.SetCreateIfMissing(true)
 	opts.SetErrorIfExists(true)
+	useComparator(opts)
 
 	db, err = levigo.Open(dirpath, opts)
 	if err != nil {
@@ -192,11 +1612,21 @@ func setup(tb testing.TB) string {
 
 	ro = levigo.NewReadOptions()
 	wo = levigo.NewWriteOptions()
+	dbPath = dirpath
+	gate.setOpen(true)
+
+	if err := loadIndexes(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := loadBuckets(); err != nil {
+		tb.Fatal(err)
+	}
 
 	return dirpath
 }
 
 func cleanup(path string) {
+	gate.setOpen(false)
 	if db != nil {
 		db.Close()
 	}
@@ -207,6 +1637,7 @@ func cleanup(path string) {
 		wo.Close()
 	}
 	os.RemoveAll(path)
+	os.RemoveAll(path + ".prev")
 }
 
 func assert(tb testing.TB, cond bool, msg string, args ...interface{}) {
@@ -0,0 +1,107 @@
+package libldbrest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Limits bound the size of requests. A zero limit is no limit.
+type Limits struct {
+	// bytes in any request body
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// bytes in a single value, via PUT /key or a /batch "put"
+	MaxValueSize int `json:"max_value_size"`
+
+	// bytes in a single key
+	MaxKeyLength int `json:"max_key_length"`
+
+	// keys in a POST /keys
+	MaxKeys int `json:"max_keys"`
+
+	// ops in a POST /batch
+	MaxBatchOps int `json:"max_batch_ops"`
+}
+
+// DefaultLimits are in effect unless SetLimits is called
+var DefaultLimits = Limits{
+	MaxBodySize:  64 << 20,
+	MaxValueSize: 64 << 20,
+	MaxKeyLength: 64 << 10,
+	MaxKeys:      10000,
+	MaxBatchOps:  10000,
+}
+
+var limits = DefaultLimits
+
+// SetLimits replaces the request size limits.
+// It should be called before InitRouter.
+func SetLimits(l Limits) {
+	limits = l
+}
+
+// error codes for exceeded limits
+const (
+	codeTooLarge      = "too_large"      // 413, the body or a value is too big
+	codeLimitExceeded = "limit_exceeded" // 400, too many keys or ops, or too long a key
+)
+
+// bounded wraps an endpoint to cap the size of its request body
+func bounded(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if limits.MaxBodySize > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodySize)
+		}
+		h(w, r, p)
+	}
+}
+
+// isTooLarge reports whether err came from reading past the body size limit
+func isTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+func failTooLarge(w http.ResponseWriter, msg string) {
+	fail(w, http.StatusRequestEntityTooLarge, &apiError{Code: codeTooLarge, Message: msg})
+}
+
+func failBodyTooLarge(w http.ResponseWriter) {
+	failTooLarge(w, fmt.Sprintf("request body is over the %d byte limit", limits.MaxBodySize))
+}
+
+func failLimit(w http.ResponseWriter, msg string) {
+	failBadRequest(w, codeLimitExceeded, msg)
+}
+
+// keyLengthErr explains why key is too long, or is "" if it isn't
+// (a bucket's keys are measured without the bucket's prefix)
+func keyLengthErr(key []byte) string {
+	if _, bkey, ok := splitBucketKey(key); ok {
+		key = bkey
+	}
+	if limits.MaxKeyLength > 0 && len(key) > limits.MaxKeyLength {
+		return fmt.Sprintf("key is %d bytes, over the %d byte limit", len(key), limits.MaxKeyLength)
+	}
+	return ""
+}
+
+// valueSizeErr explains why value is too big, or is "" if it isn't
+func valueSizeErr(value []byte) string {
+	if limits.MaxValueSize > 0 && len(value) > limits.MaxValueSize {
+		return fmt.Sprintf("value is %d bytes, over the %d byte limit", len(value), limits.MaxValueSize)
+	}
+	return ""
+}
+
+// checkKeyLength 400s (and returns false) if key is too long
+func checkKeyLength(w http.ResponseWriter, key []byte) bool {
+	if msg := keyLengthErr(key); msg != "" {
+		failLimit(w, msg)
+		return false
+	}
+	return true
+}
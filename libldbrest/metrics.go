@@ -0,0 +1,329 @@
+package libldbrest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// a minimal implementation of the prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/)
+
+var (
+	requestsTotal = newCounter(
+		"ldbrest_requests_total",
+		"HTTP requests by route, method and response code.")
+	requestSeconds = newHistogram(
+		"ldbrest_request_duration_seconds",
+		"HTTP request latencies by route and method.",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+	valueBytesRead = newCounter(
+		"ldbrest_value_bytes_read_total",
+		"Bytes of values read from the db and returned to clients.")
+	valueBytesWritten = newCounter(
+		"ldbrest_value_bytes_written_total",
+		"Bytes of values written to the db by clients.")
+	iterateItems = newCounter(
+		"ldbrest_iterate_items_total",
+		"Keys (or key/value pairs) returned by /iterate.")
+	batchOps = newHistogram(
+		"ldbrest_batch_ops",
+		"Number of operations in each /batch.",
+		[]float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000})
+	snapshotSeconds = newHistogram(
+		"ldbrest_snapshot_duration_seconds",
+		"Time taken to copy out each successful /snapshot.",
+		[]float64{.1, .5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600})
+)
+
+// every metric that writeMetrics exports, in order
+var allMetrics = []metric{
+	requestsTotal,
+	requestSeconds,
+	valueBytesRead,
+	valueBytesWritten,
+	iterateItems,
+	batchOps,
+	snapshotSeconds,
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders alternating names and values as `name1="value1",...`
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedKeys gives a stable output order for labelled values
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// series writes one sample line
+func series(w io.Writer, name, lbls string, value float64) {
+	if lbls == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+	} else {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, lbls, formatFloat(value))
+	}
+}
+
+type counter struct {
+	mu         sync.Mutex
+	name, help string
+	values     map[string]float64 // by rendered labels
+}
+
+func newCounter(name, help string) *counter {
+	return &counter{name: name, help: help, values: make(map[string]float64)}
+}
+
+func (c *counter) add(lbls string, v float64) {
+	c.mu.Lock()
+	c.values[lbls] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.values) == 0 {
+		series(w, c.name, "", 0)
+	}
+	for _, lbls := range sortedKeys(c.values) {
+		series(w, c.name, lbls, c.values[lbls])
+	}
+}
+
+type histogram struct {
+	mu         sync.Mutex
+	name, help string
+	buckets    []float64
+	counts     map[string][]uint64 // by rendered labels, one per bucket plus +Inf
+	sums       map[string]float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+	}
+}
+
+func (h *histogram) observe(lbls string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts, ok := h.counts[lbls]
+	if !ok {
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[lbls] = counts
+	}
+	counts[sort.SearchFloat64s(h.buckets, v)]++
+	h.sums[lbls] += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, lbls := range sortedKeys(h.sums) {
+		sep := ""
+		if lbls != "" {
+			sep = ","
+		}
+
+		var cumulative uint64
+		for i, count := range h.counts[lbls] {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			series(w, h.name+"_bucket", lbls+sep+labels("le", le), float64(cumulative))
+		}
+		series(w, h.name+"_sum", lbls, h.sums[lbls])
+		series(w, h.name+"_count", lbls, float64(cumulative))
+	}
+}
+
+// statusRecorder is an http.ResponseWriter that remembers
+// the response code and how much body was written
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.code == 0 {
+		sr.code = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.code == 0 {
+		sr.code = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Flush passes through to the underlying ResponseWriter, for responses
+// that are streamed
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		if sr.code == 0 {
+			sr.code = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// ReadFrom passes through too, so that io.Copy to the response (as from
+// http.ServeContent) can still use sendfile
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if sr.code == 0 {
+		sr.code = http.StatusOK
+	}
+	n, err := io.Copy(sr.ResponseWriter, src)
+	sr.bytes += int(n)
+	return n, err
+}
+
+func (sr *statusRecorder) status() int {
+	if sr.code == 0 {
+		return http.StatusOK
+	}
+	return sr.code
+}
+
+// instrumented wraps an endpoint to count its requests, time them
+// and write them to the access log
+func instrumented(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		r, info := withReqInfo(r)
+
+		h(sr, r, p)
+
+		requestsTotal.add(labels("route", route, "method", r.Method, "code", strconv.Itoa(sr.status())), 1)
+		requestSeconds.observe(labels("route", route, "method", r.Method), time.Since(start).Seconds())
+		logAccess(r, route, info, sr, start)
+	}
+}
+
+// serveMetrics responds with all the metrics, plus gauges from leveldb's
+// properties if the db is available
+func serveMetrics(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, m := range allMetrics {
+		m.write(bw)
+	}
+
+	if gate.unavailable() != "" {
+		return
+	}
+	gate.mu.RLock()
+	defer gate.mu.RUnlock()
+	writeLevelDBGauges(bw)
+}
+
+// the number of levels leveldb keeps (config::kNumLevels)
+const numLevels = 7
+
+func writeLevelDBGauges(w io.Writer) {
+	name := "ldbrest_leveldb_num_files"
+	fmt.Fprintf(w, "# HELP %s Number of files at each level (leveldb.num-files-at-level<N>).\n# TYPE %s gauge\n", name, name)
+	for level := 0; level < numLevels; level++ {
+		prop := db.PropertyValue(fmt.Sprintf("leveldb.num-files-at-level%d", level))
+		if n, err := strconv.ParseFloat(prop, 64); err == nil {
+			series(w, name, labels("level", strconv.Itoa(level)), n)
+		}
+	}
+
+	// leveldb.stats is a table like:
+	//                                Compactions
+	// Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+	// --------------------------------------------------
+	//   0        1        0         0        0         0
+	columns := []struct {
+		name, help string
+		scale      float64
+	}{
+		{"ldbrest_leveldb_level_files", "Number of files at each level (leveldb.stats).", 1},
+		{"ldbrest_leveldb_level_size_bytes", "Size of each level (leveldb.stats).", 1 << 20},
+		{"ldbrest_leveldb_compaction_seconds", "Time spent compacting into each level (leveldb.stats).", 1},
+		{"ldbrest_leveldb_compaction_read_bytes", "Bytes read compacting into each level (leveldb.stats).", 1 << 20},
+		{"ldbrest_leveldb_compaction_write_bytes", "Bytes written compacting into each level (leveldb.stats).", 1 << 20},
+	}
+	rows := parseStats(db.PropertyValue("leveldb.stats"))
+	for i, col := range columns {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", col.name, col.help, col.name)
+		for _, row := range rows {
+			series(w, col.name, labels("level", row.level), row.values[i]*col.scale)
+		}
+	}
+}
+
+type statsRow struct {
+	level  string
+	values [5]float64
+}
+
+func parseStats(stats string) []statsRow {
+	var rows []statsRow
+	for _, line := range strings.Split(stats, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue // the header
+		}
+
+		row := statsRow{level: fields[0]}
+		for i, f := range fields[1:] {
+			row.values[i], _ = strconv.ParseFloat(f, 64)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
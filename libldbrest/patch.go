@@ -0,0 +1,365 @@
+package libldbrest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// patch formats, also the Content-Types that select them
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7386
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+func badPatch(msg string) *apiError {
+	return &apiError{Code: codeBadPatch, Message: msg, status: http.StatusBadRequest}
+}
+
+func patchConflict(code, msg string) *apiError {
+	return &apiError{Code: code, Message: msg, status: http.StatusConflict}
+}
+
+// errNoKey is for a PATCH of a missing key without ?upsert=yes
+var errNoKey = &apiError{Code: statusCodes[http.StatusNotFound], Message: http.StatusText(http.StatusNotFound), status: http.StatusNotFound}
+
+// applyPatch patches the JSON document stored as value (nil for a missing
+// key, which patches like null), producing the new document. format is one
+// of the patch types, or "" to tell by the patch: a JSON Patch is always an
+// array, which as a merge patch would just replace the whole document.
+// errors from a bad patch or a document it can't apply to are *apiErrors.
+func applyPatch(value, patch []byte, format string) ([]byte, error) {
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return nil, badPatch("invalid JSON patch: " + err.Error())
+	}
+
+	var doc interface{}
+	if value != nil {
+		if doc, err = decodeJSON(value); err != nil {
+			return nil, patchConflict(codeNotJSON, "stored value is not JSON")
+		}
+	}
+
+	if format == "" {
+		format = mergePatchType
+		if _, ok := p.([]interface{}); ok {
+			format = jsonPatchType
+		}
+	}
+
+	switch format {
+	case mergePatchType:
+		doc = mergePatch(doc, p)
+	case jsonPatchType:
+		ops, ok := p.([]interface{})
+		if !ok {
+			return nil, badPatch("a JSON Patch must be an array of operations")
+		}
+		for i, op := range ops {
+			if doc, err = applyPatchOp(doc, op); err != nil {
+				if ae, ok := err.(*apiError); ok {
+					ae.Message = fmt.Sprintf("operation %d: %s", i, ae.Message)
+				}
+				return nil, err
+			}
+		}
+	default:
+		return nil, badPatch("unknown patch format " + format)
+	}
+
+	return encodeJSON(doc)
+}
+
+// decodeJSON parses a single JSON value, keeping numbers as written
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+func encodeJSON(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// mergePatch applies an RFC 7386 merge patch
+func mergePatch(doc, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	dm, ok := doc.(map[string]interface{})
+	if !ok {
+		dm = make(map[string]interface{})
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(dm, k)
+		} else {
+			dm[k] = mergePatch(dm[k], v)
+		}
+	}
+	return dm
+}
+
+// applyPatchOp applies one RFC 6902 JSON Patch operation
+func applyPatchOp(doc interface{}, raw interface{}) (interface{}, error) {
+	op, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, badPatch("must be an object")
+	}
+
+	path, err := patchPointer(op, "path")
+	if err != nil {
+		return nil, err
+	}
+
+	value, hasValue := op["value"]
+	switch op["op"] {
+	case "add", "replace", "test":
+		if !hasValue {
+			return nil, badPatch(`missing "value"`)
+		}
+	}
+
+	switch op["op"] {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		return pointerRemove(doc, path)
+	case "replace":
+		if doc, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move", "copy":
+		from, err := patchPointer(op, "from")
+		if err != nil {
+			return nil, err
+		}
+		if value, err = pointerGet(doc, from); err != nil {
+			return nil, err
+		}
+		if op["op"] == "copy" {
+			// the copy mustn't share maps or slices with the original
+			b, _ := encodeJSON(value)
+			value, _ = decodeJSON(b)
+		} else {
+			if len(path) > len(from) && pointerHasPrefix(path, from) {
+				return nil, patchConflict(codePatchFailed, "can't move a value into itself")
+			}
+			if doc, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		}
+		return pointerAdd(doc, path, value)
+	case "test":
+		actual, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(actual, value) {
+			return nil, patchConflict(codePatchFailed, "test failed")
+		}
+		return doc, nil
+	}
+	return nil, badPatch(fmt.Sprintf("unknown op %v", op["op"]))
+}
+
+// patchPointer parses the RFC 6901 JSON Pointer in an op's field into its
+// reference tokens
+func patchPointer(op map[string]interface{}, field string) ([]string, error) {
+	s, ok := op[field].(string)
+	if !ok {
+		return nil, badPatch(fmt.Sprintf("%q must be a string", field))
+	}
+	if s == "" {
+		return []string{}, nil
+	}
+	if s[0] != '/' {
+		return nil, badPatch(fmt.Sprintf("%q must be empty or start with /", field))
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, tok := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(tok, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func pointerHasPrefix(path, prefix []string) bool {
+	for i, tok := range prefix {
+		if path[i] != tok {
+			return false
+		}
+	}
+	return true
+}
+
+func notFound(tok string) *apiError {
+	return patchConflict(codePatchFailed, fmt.Sprintf("path component %q doesn't exist", tok))
+}
+
+// arrayIndex reads a token as an index into an array of length n, or
+// past its end if allowed
+func arrayIndex(tok string, n int, pastEnd bool) (int, error) {
+	if pastEnd && tok == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || i > n || i == n && !pastEnd || tok != strconv.Itoa(i) {
+		return 0, notFound(tok)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, ok := node[tok]
+			if !ok {
+				return nil, notFound(tok)
+			}
+			doc = child
+		case []interface{}:
+			i, err := arrayIndex(tok, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, notFound(tok)
+		}
+	}
+	return doc, nil
+}
+
+// pointerEdit replaces the container holding the last token of path with
+// what edit makes of it, returning the new document
+func pointerEdit(doc interface{}, path []string, edit func(parent interface{}, tok string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return edit(doc, path[0])
+	}
+
+	child, err := pointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = pointerEdit(child, path[1:], edit); err != nil {
+		return nil, err
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(node), false)
+		node[i] = child
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerEdit(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[tok] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, notFound(tok)
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	return pointerEdit(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[tok]; !ok {
+				return nil, notFound(tok)
+			}
+			delete(node, tok)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, notFound(tok)
+	})
+}
+
+// jsonEqual compares decoded JSON values, numbers by their exact value
+// (so 1 and 1.0 are equal, but not two integers a float64 can't tell apart)
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		ar, aok := new(big.Rat).SetString(a.String())
+		br, bok := new(big.Rat).SetString(bn.String())
+		return aok && bok && ar.Cmp(br) == 0
+	case map[string]interface{}:
+		bm, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, v := range a {
+			if bv, ok := bm[k]; !ok || !jsonEqual(v, bv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bs, ok := b.([]interface{})
+		if !ok || len(a) != len(bs) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,41 @@
+package libldbrest
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+const peerUIDKey ctxKey = tokenKey + 1
+
+// ConnContext is meant as the ConnContext of an *http.Server. for unix
+// socket connections it records the peer's uid, so requests can be matched
+// to "uid:<uid>" ACL rules.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	uid, err := unixPeerUID(uc)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerUIDKey, uid)
+}
+
+// peerUID is the uid of the process at the other end of the request's unix
+// socket connection, if that's how it came in
+func peerUID(r *http.Request) (int, bool) {
+	uid, ok := r.Context().Value(peerUIDKey).(int)
+	return uid, ok
+}
+
+// clientCN is the common name of the request's verified TLS client
+// certificate, if it came in over mutual TLS
+func clientCN(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
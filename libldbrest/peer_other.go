@@ -0,0 +1,12 @@
+//go:build !linux
+
+package libldbrest
+
+import (
+	"errors"
+	"net"
+)
+
+func unixPeerUID(uc *net.UnixConn) (int, error) {
+	return 0, errors.New("unix socket peer credentials are only supported on linux")
+}
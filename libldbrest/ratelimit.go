@@ -0,0 +1,191 @@
+package libldbrest
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RateLimit is a token bucket: Rate requests per second on average, with
+// bursts of up to Burst at once. A zero Rate is no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// the kinds of request that are rate limited separately
+const (
+	classNone = iota
+	classRead
+	classWrite
+	classScan
+)
+
+var (
+	rateLimiters [classScan + 1]*rateLimiter
+
+	// a semaphore capping concurrent expensive requests,
+	// nil if they aren't capped
+	expensive chan struct{}
+)
+
+// SetRateLimits sets per-client rate limits for reads (GET /key and POST
+// /keys), writes (PUT and DELETE /key and POST /batch) and scans (GET
+// /iterate). Clients are told apart by API token, TLS client certificate,
+// unix socket peer uid or else IP address.
+func SetRateLimits(read, write, scan RateLimit) {
+	for class, rl := range map[int]RateLimit{classRead: read, classWrite: write, classScan: scan} {
+		if rl.Rate > 0 {
+			rateLimiters[class] = newRateLimiter(rl)
+		} else {
+			rateLimiters[class] = nil
+		}
+	}
+}
+
+// SetMaxExpensive caps how many expensive requests (GET /iterate and POST
+// /snapshot) can run at once across all clients. Zero is no cap.
+func SetMaxExpensive(n int) {
+	if n > 0 {
+		expensive = make(chan struct{}, n)
+	} else {
+		expensive = nil
+	}
+}
+
+// rateClass says how requests to route with method are rate limited
+func rateClass(route, method string) int {
+	switch route {
+	case "key", "txn":
+		if method == "GET" || method == "HEAD" {
+			return classRead
+		}
+		return classWrite
+	case "keys":
+		return classRead
+	case "batch":
+		return classWrite
+	case "iterate", "index", "bucketstats":
+		return classScan
+	}
+	return classNone
+}
+
+func isExpensive(route string) bool {
+	return route == "iterate" || route == "index" || route == "bucketstats" || route == "snapshot"
+}
+
+// clientID identifies who a request counts against for rate limiting
+func clientID(r *http.Request) string {
+	if tok := requestToken(r); tok != "" {
+		return "token:" + tok
+	}
+	if cn, ok := clientCN(r); ok {
+		return "cn:" + cn
+	}
+	if uid, ok := peerUID(r); ok {
+		return "uid:" + strconv.Itoa(uid)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+func failRateLimited(w http.ResponseWriter, wait time.Duration, msg string) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	fail(w, http.StatusTooManyRequests, &apiError{Code: codeRateLimited, Message: msg})
+}
+
+// limited wraps an endpoint to enforce the rate limits and concurrency cap
+func limited(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if rl := rateLimiters[rateClass(route, r.Method)]; rl != nil {
+			if wait := rl.take(clientID(r)); wait > 0 {
+				failRateLimited(w, wait, "rate limit exceeded")
+				return
+			}
+		}
+
+		if sem := expensive; sem != nil && isExpensive(route) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			default:
+				failRateLimited(w, time.Second, "too many expensive requests in progress")
+				return
+			}
+		}
+
+		h(w, r, p)
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   RateLimit
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{limit: limit, buckets: make(map[string]*bucket), pruned: time.Now()}
+}
+
+// take uses up one of client's tokens. if there aren't any it returns how
+// long until there will be, otherwise zero.
+func (rl *rateLimiter) take(client string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(rl.limit.Burst), last: now}
+		rl.buckets[client] = b
+	}
+
+	b.tokens = math.Min(float64(rl.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*rl.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rl.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// prune forgets clients whose buckets would have refilled by now anyway
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.pruned) < time.Minute {
+		return
+	}
+	rl.pruned = now
+
+	refill := time.Duration(float64(rl.limit.Burst) / rl.limit.Rate * float64(time.Second))
+	for client, b := range rl.buckets {
+		if now.Sub(b.last) > refill {
+			delete(rl.buckets, client)
+		}
+	}
+}
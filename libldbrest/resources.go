@@ -1,6 +1,7 @@
 package libldbrest
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/jmhodges/levigo"
@@ -10,26 +11,65 @@ var (
 	db *levigo.DB
 	ro *levigo.ReadOptions
 	wo *levigo.WriteOptions
+
+	// dbPath is where the open leveldb lives on disk
+	dbPath string
 )
 
 // OpenDB intializes global vars for the leveldb database.
 // Be sure and call CleanupDB() to free those resources.
 func OpenDB(dbpath string) {
+	if err := finishSwap(dbpath); err != nil {
+		log.Fatalf("finishing an interrupted restore: %s", err)
+	}
+	if err := openDB(dbpath); err != nil {
+		log.Fatalf("opening leveldb: %s", err)
+	}
+}
+
+func openDB(dbpath string) error {
+	if err := checkComparator(dbpath); err != nil {
+		return err
+	}
+
 	opts := levigo.NewOptions()
 	opts.SetCreateIfMissing(true)
+	useComparator(opts)
 	defer opts.Close()
 	ldb, err := levigo.Open(dbpath, opts)
 	if err != nil {
-		log.Fatalf("opening leveldb: %s", err)
+		return err
+	}
+	if err := markComparator(dbpath); err != nil {
+		ldb.Close()
+		return err
 	}
 
 	db = ldb
 	ro = levigo.NewReadOptions()
 	wo = levigo.NewWriteOptions()
+	dbPath = dbpath
+
+	if err := loadIndexes(); err != nil {
+		CleanupDB()
+		return fmt.Errorf("loading index definitions: %s", err)
+	}
+	if err := loadBuckets(); err != nil {
+		CleanupDB()
+		return fmt.Errorf("loading bucket definitions: %s", err)
+	}
+	if err := sweepUploads(); err != nil {
+		CleanupDB()
+		return fmt.Errorf("clearing interrupted uploads: %s", err)
+	}
+	gate.setOpen(true)
+	return nil
 }
 
 // CleanupDB frees the global vars associated with the open leveldb.
 func CleanupDB() {
+	gate.setOpen(false)
+	endTxns()
 	wo.Close()
 	ro.Close()
 	db.Close()
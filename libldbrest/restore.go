@@ -0,0 +1,238 @@
+package libldbrest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jmhodges/levigo"
+)
+
+// only one restore may run at a time
+var restoreMu sync.Mutex
+
+var errNoPrevious = errors.New("no previous database to restore")
+
+// prevPath is where the database replaced by the latest restore is kept
+func prevPath() string {
+	return dbPath + ".prev"
+}
+
+// a swap moves the served database aside to swapPath, and moves the new one
+// into place. swapJournal exists from just before the first move until the
+// old database has been moved on to prevPath (or back), so that finishSwap
+// can tell a swap was cut short.
+func swapPath(path string) string {
+	return path + ".swap"
+}
+
+func swapJournal(path string) string {
+	return path + ".swapping"
+}
+
+// stagePath is where a snapshot is copied to before it's swapped in
+func stagePath(path string) string {
+	return path + ".restore"
+}
+
+// restoreSource resolves a snapshot name or path. bare names are looked up
+// alongside the served database, where a relative snapshot destination from
+// the same working directory would usually have put it.
+func restoreSource(source string) string {
+	if filepath.IsAbs(source) || filepath.Base(source) != source {
+		return source
+	}
+	return filepath.Join(filepath.Dir(dbPath), source)
+}
+
+// restoreSnap replaces the served database with a copy of the one at
+// source, moving the current database to prevPath() (replacing anything
+// already there). the snapshot itself is left as it was.
+//
+// requests are held off with 503s for the duration of the swap, but not
+// while the snapshot is copied.
+func restoreSnap(source string) error {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+
+	source = restoreSource(source)
+	if err := checkDB(source); err != nil {
+		return &apiError{Code: codeBadSnapshot, Message: err.Error()}
+	}
+
+	stage := stagePath(dbPath)
+	if err := os.RemoveAll(stage); err != nil {
+		return err
+	}
+	if err := copyDir(source, stage); err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	if err := swapDB(stage); err != nil {
+		os.RemoveAll(stage)
+		return err
+	}
+	return nil
+}
+
+// copyDir copies the files in a database directory (which has no
+// subdirectories) into a new directory
+func copyDir(src, dst string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dst, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// undoRestore puts back the database that the last restore replaced. the
+// database it replaces is in turn kept, so an undo can itself be undone.
+func undoRestore() error {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+
+	if _, err := os.Stat(prevPath()); os.IsNotExist(err) {
+		return errNoPrevious
+	}
+	return swapDB(prevPath())
+}
+
+// checkDB makes sure there is a usable leveldb at path, in our key order
+func checkDB(path string) error {
+	if err := checkComparator(path); err != nil {
+		return err
+	}
+
+	opts := levigo.NewOptions()
+	useComparator(opts)
+	defer opts.Close()
+	ldb, err := levigo.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	ldb.Close()
+	return nil
+}
+
+func swapDB(source string) error {
+	// background jobs belong to the db going away
+	cancelJobs()
+	gate.pause()
+	defer gate.resume()
+
+	path := dbPath
+	CleanupDB()
+
+	tmp := swapPath(path)
+	if err := os.RemoveAll(tmp); err != nil {
+		return reopen(path, err)
+	}
+	journal := swapJournal(path)
+	if err := ioutil.WriteFile(journal, []byte(source+"\n"), 0644); err != nil {
+		return reopen(path, err)
+	}
+	if err := os.Rename(path, tmp); err != nil {
+		os.Remove(journal)
+		return reopen(path, err)
+	}
+	if err := os.Rename(source, path); err != nil {
+		os.Rename(tmp, path)
+		os.Remove(journal)
+		return reopen(path, err)
+	}
+
+	if err := openDB(path); err != nil {
+		// put the old database back the way it was
+		os.Rename(path, source)
+		os.Rename(tmp, path)
+		os.Remove(journal)
+		return reopen(path, err)
+	}
+
+	prev := prevPath()
+	if err := os.RemoveAll(prev); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, prev); err != nil {
+		return err
+	}
+	return os.Remove(journal)
+}
+
+// finishSwap tidies up after a swap that the process died in the middle of,
+// before the database at path is opened. if the old database was moved
+// aside and nothing took its place it goes back; if the new one made it into
+// place the swap is finished by moving the old one on to the ".prev" path.
+func finishSwap(path string) error {
+	journal := swapJournal(path)
+	if _, err := os.Stat(journal); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tmp := swapPath(path)
+	if _, err := os.Stat(tmp); err == nil {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			log.Printf("restore: interrupted swap, putting %s back", path)
+			if err := os.Rename(tmp, path); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("restore: interrupted swap, finishing it")
+			if err := os.RemoveAll(path + ".prev"); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, path+".prev"); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(journal)
+}
+
+// reopen tries to get the original database back after a failed swap
+func reopen(path string, cause error) error {
+	if err := openDB(path); err != nil {
+		return fmt.Errorf("%s (and reopening %s failed: %s)", cause, path, err)
+	}
+	return cause
+}
@@ -1,12 +1,80 @@
 package libldbrest
 
-import "github.com/jmhodges/levigo"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jmhodges/levigo"
+)
+
+// snapSpec limits which keys a snapshot copies, and optionally
+// rewrites them on their way into the destination database
+type snapSpec struct {
+	Destination string
+
+	// only copy keys in [start, end) that begin with prefix
+	Start, End, Prefix string
+
+	// remove this leading string from copied keys that have it
+	StripPrefix string `json:"strip_prefix"`
+}
+
+// seekKey is the first key the snapshot should consider
+func (spec *snapSpec) seekKey() []byte {
+	// only bytewise keeps a prefix's keys together
+	if !keyOrder.custom() && spec.Prefix > spec.Start {
+		return []byte(spec.Prefix)
+	}
+	return []byte(spec.Start)
+}
+
+// done reports whether key (and so every key after it) is out of range
+func (spec *snapSpec) done(key []byte) bool {
+	if spec.End != "" && compareKeys(key, []byte(spec.End)) >= 0 {
+		return true
+	}
+	return !keyOrder.custom() && !spec.wanted(key)
+}
+
+// wanted reports whether key has the prefix
+func (spec *snapSpec) wanted(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(spec.Prefix))
+}
+
+// rewrite produces the key to store in the destination, or nil for a key
+// that would be stripped down to nothing
+func (spec *snapSpec) rewrite(key []byte) []byte {
+	if spec.StripPrefix != "" {
+		key = bytes.TrimPrefix(key, []byte(spec.StripPrefix))
+		if len(key) == 0 {
+			return nil
+		}
+	}
+	return key
+}
+
+// check rejects a strip_prefix that could make two copied keys collide, as
+// it could if some of them didn't have it
+func (spec *snapSpec) check() error {
+	if !strings.HasPrefix(spec.Prefix, spec.StripPrefix) {
+		return errors.New(`"strip_prefix" must be the start of "prefix"`)
+	}
+	return nil
+}
+
+// makeSnap copies the keys spec calls for into a new database. it gives up
+// (and removes the partial copy) if ctx is cancelled.
+func makeSnap(ctx context.Context, spec *snapSpec) error {
+	dest := spec.Destination
+	partial := spec.Start != "" || spec.End != "" || spec.Prefix != ""
 
-func makeSnap(dest string) error {
 	opts := levigo.NewOptions()
 	defer opts.Close()
 	opts.SetCreateIfMissing(true)
 	opts.SetErrorIfExists(true)
+	useComparator(opts)
 	to, err := levigo.Open(dest, opts)
 	if err != nil {
 		return err
@@ -14,6 +82,7 @@ func makeSnap(dest string) error {
 	defer to.Close()
 
 	ss := db.NewSnapshot()
+	defer db.ReleaseSnapshot(ss)
 	sro := levigo.NewReadOptions()
 	defer sro.Close()
 	sro.SetSnapshot(ss)
@@ -24,19 +93,64 @@ func makeSnap(dest string) error {
 
 	wb := levigo.NewWriteBatch()
 
+	if seek := spec.seekKey(); len(seek) == 0 {
+		it.SeekToFirst()
+	} else {
+		it.Seek(seek)
+	}
+
 	var i uint
-	for it.SeekToFirst(); it.Valid(); it.Next() {
-		wb.Put(it.Key(), it.Value())
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+
+		// partial copies leave out the internal keyspace, where index
+		// entries and bucket keys would be cut off from their definitions
+		if partial && isInternal(key) {
+			if !skipInternal(it, false) {
+				break
+			}
+			key = it.Key()
+		}
+
+		if spec.done(key) {
+			break
+		}
+		rewritten := spec.rewrite(key)
+		if !spec.wanted(key) || rewritten == nil {
+			continue
+		}
+
+		wb.Put(rewritten, it.Value())
 		i++
 
+		// chunks are internal keys too, so bring chunked values' along
+		// explicitly
+		if partial {
+			if h, _ := decodeValue(it.Value()); h.Chunks != nil {
+				if err = copyChunks(to, sro, h.Chunks); err != nil {
+					wb.Close()
+					goto fail
+				}
+			}
+		}
+
 		if i%1000 == 0 {
 			wb, err = dumpBatch(wb, to, true)
 			if err != nil {
 				goto fail
 			}
+			if err = ctx.Err(); err != nil {
+				wb.Close()
+				goto fail
+			}
 		}
 	}
 
+	if err = it.GetError(); err != nil {
+		wb.Close()
+		goto fail
+	}
+
 	if i%1000 != 0 {
 		_, err = dumpBatch(wb, to, false)
 		if err != nil {
@@ -46,6 +160,9 @@ func makeSnap(dest string) error {
 		wb.Close()
 	}
 
+	if err = markComparator(dest); err != nil {
+		goto fail
+	}
 	return nil
 
 fail:
@@ -53,6 +170,24 @@ fail:
 	return err
 }
 
+// copyChunks copies a chunked value's chunks into dest
+func copyChunks(dest *levigo.DB, sro *levigo.ReadOptions, info *chunkInfo) error {
+	for i := int64(0); i < info.count(); i++ {
+		key := chunkKey(info.ID, i)
+		chunk, err := db.Get(sro, key)
+		if err != nil {
+			return err
+		}
+		if chunk == nil {
+			return errChunkMissing
+		}
+		if err := dest.Put(wo, key, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func dumpBatch(wb *levigo.WriteBatch, dest *levigo.DB, more bool) (*levigo.WriteBatch, error) {
 	defer wb.Close()
 
@@ -0,0 +1,370 @@
+package libldbrest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tuple keys are JSON arrays encoded like FoundationDB's tuple layer, so that
+// they sort element by element: by type, then numerically, chronologically or
+// bytewise within a type. integers and floats are different types, so every
+// integer sorts before every float (as in the tuple layer). times are given
+// as {"$time": "<RFC 3339>"}, and the type codes are the tuple layer's plus
+// one of its user types for them.
+const (
+	tupleNull    = 0x00
+	tupleString  = 0x02
+	tupleNested  = 0x05
+	tupleBigNeg  = 0x0b
+	tupleIntZero = 0x14
+	tupleBigPos  = 0x1d
+	tupleDouble  = 0x21
+	tupleFalse   = 0x26
+	tupleTrue    = 0x27
+	tupleTime    = 0x40
+)
+
+// timeField is the one key of the objects that stand for times in tuples
+const timeField = "$time"
+
+var errBadTuple = errors.New("key isn't an encoded tuple")
+
+// tupleKeys reports whether the request asks for its keys to be tuples
+func tupleKeys(r *http.Request) bool {
+	return r.URL.Query().Get("key_format") == "tuple"
+}
+
+// parseTupleKey encodes a tuple key given as JSON
+func parseTupleKey(s []byte) ([]byte, error) {
+	v, err := decodeJSON(s)
+	tuple, ok := v.([]interface{})
+	if err != nil || !ok {
+		return nil, errors.New("tuple keys must be JSON arrays")
+	}
+	return encodeTuple([]byte{}, tuple, false)
+}
+
+// encodeTuple appends the encoding of a tuple's elements to b
+func encodeTuple(b []byte, tuple []interface{}, nested bool) ([]byte, error) {
+	for _, elem := range tuple {
+		var err error
+		if b, err = encodeTupleElem(b, elem, nested); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func encodeTupleElem(b []byte, elem interface{}, nested bool) ([]byte, error) {
+	switch v := elem.(type) {
+	case nil:
+		if nested {
+			// so it can't be mistaken for the end of the nested tuple
+			return append(b, tupleNull, 0xff), nil
+		}
+		return append(b, tupleNull), nil
+	case bool:
+		if v {
+			return append(b, tupleTrue), nil
+		}
+		return append(b, tupleFalse), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return encodeTupleInt(b, n), nil
+		}
+		if !strings.ContainsAny(string(v), ".eE") {
+			// an integer too big for an int64
+			if n, ok := new(big.Int).SetString(string(v), 10); ok {
+				return encodeTupleBigInt(b, n)
+			}
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return encodeTupleDouble(b, f), nil
+	case string:
+		return append(appendEscaped(append(b, tupleString), []byte(v)), 0), nil
+	case map[string]interface{}:
+		s, ok := v[timeField].(string)
+		if !ok || len(v) != 1 {
+			return nil, fmt.Errorf(`the only objects tuples can have are times, {"%s": "<RFC 3339>"}`, timeField)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("bad time in tuple: %s", err)
+		}
+		return encodeTupleTime(b, t), nil
+	case []interface{}:
+		b, err := encodeTuple(append(b, tupleNested), v, true)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, 0), nil
+	}
+	return nil, fmt.Errorf("tuple elements can't be %T", elem)
+}
+
+// appendEscaped appends s with every 0x00 escaped as 0x00 0xff
+func appendEscaped(b, s []byte) []byte {
+	for _, c := range s {
+		b = append(b, c)
+		if c == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	return b
+}
+
+// integers are their minimal big-endian bytes after a type code saying how
+// many there are, with negatives one's complemented and given lower codes
+func encodeTupleInt(b []byte, n int64) []byte {
+	if n == 0 {
+		return append(b, tupleIntZero)
+	}
+
+	u := uint64(n)
+	if n < 0 {
+		u = uint64(-(n + 1)) + 1 // |n|, without overflowing for the minimum
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], u)
+	size := 8
+	for size > 1 && buf[8-size] == 0 {
+		size--
+	}
+	digits := buf[8-size:]
+
+	if n > 0 {
+		return append(append(b, byte(tupleIntZero+size)), digits...)
+	}
+	b = append(b, byte(tupleIntZero-size))
+	for _, d := range digits {
+		b = append(b, ^d)
+	}
+	return b
+}
+
+// integers past int64 are the tuple layer's arbitrary-precision ones: a
+// type code by sign, then a byte with the number of big-endian bytes that
+// follow, with both complemented for negatives
+func encodeTupleBigInt(b []byte, n *big.Int) ([]byte, error) {
+	digits := new(big.Int).Abs(n).Bytes()
+	if len(digits) > 0xff {
+		return nil, errors.New("integer in tuple is too big")
+	}
+	if n.Sign() > 0 {
+		return append(append(b, tupleBigPos, byte(len(digits))), digits...), nil
+	}
+	b = append(b, tupleBigNeg, ^byte(len(digits)))
+	for _, d := range digits {
+		b = append(b, ^d)
+	}
+	return b, nil
+}
+
+// floats sort as their bits with the sign bit flipped for positives
+// and every bit flipped for negatives
+func encodeTupleDouble(b []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], bits)
+	return append(append(b, tupleDouble), buf[:]...)
+}
+
+// times are unix seconds (with the sign bit flipped) then nanoseconds
+func encodeTupleTime(b []byte, t time.Time) []byte {
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(buf[8:], uint32(t.Nanosecond()))
+	return append(append(b, tupleTime), buf[:]...)
+}
+
+// decodeTuple reverses encodeTuple, with times in UTC, and floats and
+// integers too big for an int64 as json.Numbers
+func decodeTuple(b []byte) ([]interface{}, error) {
+	tuple, rest, err := decodeTupleElems(b, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errBadTuple
+	}
+	return tuple, nil
+}
+
+// decodeTupleElems decodes elements up to the end of b or, in a nested
+// tuple, its terminator, returning what's left after that
+func decodeTupleElems(b []byte, nested bool) ([]interface{}, []byte, error) {
+	tuple := []interface{}{}
+	for len(b) > 0 {
+		code := b[0]
+		b = b[1:]
+
+		switch {
+		case code == tupleNull:
+			if !nested {
+				tuple = append(tuple, nil)
+			} else if len(b) > 0 && b[0] == 0xff {
+				tuple = append(tuple, nil)
+				b = b[1:]
+			} else {
+				return tuple, b, nil
+			}
+		case code == tupleFalse || code == tupleTrue:
+			tuple = append(tuple, code == tupleTrue)
+		case code == tupleString:
+			var s []byte
+			for {
+				i := bytes.IndexByte(b, 0)
+				if i < 0 {
+					return nil, nil, errBadTuple
+				}
+				s = append(s, b[:i]...)
+				if i+1 < len(b) && b[i+1] == 0xff {
+					s = append(s, 0)
+					b = b[i+2:]
+					continue
+				}
+				b = b[i+1:]
+				break
+			}
+			tuple = append(tuple, string(s))
+		case code == tupleBigNeg || code == tupleBigPos:
+			if len(b) < 1 {
+				return nil, nil, errBadTuple
+			}
+			size := int(b[0])
+			if code == tupleBigNeg {
+				size = int(^b[0])
+			}
+			if len(b) < 1+size {
+				return nil, nil, errBadTuple
+			}
+			digits := append([]byte{}, b[1:1+size]...)
+			if code == tupleBigNeg {
+				for i := range digits {
+					digits[i] = ^digits[i]
+				}
+			}
+			n := new(big.Int).SetBytes(digits)
+			if code == tupleBigNeg {
+				n.Neg(n)
+			}
+			tuple = append(tuple, json.Number(n.String()))
+			b = b[1+size:]
+		case code >= tupleIntZero-8 && code <= tupleIntZero+8:
+			size := int(code) - tupleIntZero
+			neg := size < 0
+			if neg {
+				size = -size
+			}
+			if len(b) < size {
+				return nil, nil, errBadTuple
+			}
+			var u uint64
+			for _, d := range b[:size] {
+				if neg {
+					d = ^d
+				}
+				u = u<<8 | uint64(d)
+			}
+			b = b[size:]
+			if neg {
+				tuple = append(tuple, -int64(u-1)-1)
+			} else {
+				tuple = append(tuple, int64(u))
+			}
+		case code == tupleDouble:
+			if len(b) < 8 {
+				return nil, nil, errBadTuple
+			}
+			bits := binary.BigEndian.Uint64(b)
+			if bits&(1<<63) != 0 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			f := math.Float64frombits(bits)
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				// parseTupleKey never writes these, and JSON can't show them
+				return nil, nil, errBadTuple
+			}
+			tuple = append(tuple, tupleFloat(f))
+			b = b[8:]
+		case code == tupleTime:
+			if len(b) < 12 {
+				return nil, nil, errBadTuple
+			}
+			secs := int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+			nanos := int64(binary.BigEndian.Uint32(b[8:]))
+			tuple = append(tuple, map[string]string{timeField: time.Unix(secs, nanos).UTC().Format(time.RFC3339Nano)})
+			b = b[12:]
+		case code == tupleNested:
+			inner, rest, err := decodeTupleElems(b, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			tuple = append(tuple, inner)
+			b = rest
+		default:
+			return nil, nil, errBadTuple
+		}
+	}
+	if nested {
+		// ran out before the terminator
+		return nil, nil, errBadTuple
+	}
+	return tuple, b, nil
+}
+
+// tupleFloat writes a float so that it reads back as one, not an integer
+func tupleFloat(f float64) json.Number {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return json.Number(s)
+}
+
+// tupleOps reads a /batch request body whose keys are JSON array tuples
+func tupleOps(body io.Reader) (oplist, error) {
+	req := &struct {
+		Ops []*struct {
+			Op    string
+			Key   json.RawMessage
+			Value string
+		}
+	}{}
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		return nil, err
+	}
+
+	ops := make(oplist, len(req.Ops))
+	for i, op := range req.Ops {
+		if op == nil {
+			continue // applyBatch reports it
+		}
+		key, err := parseTupleKey(op.Key)
+		if err != nil {
+			return nil, badBatchOp(i, err.Error())
+		}
+		ops[i] = &struct{ Op, Key, Value string }{op.Op, string(key), op.Value}
+	}
+	return ops, nil
+}
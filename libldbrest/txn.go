@@ -0,0 +1,255 @@
+package libldbrest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmhodges/levigo"
+)
+
+// txnTimeout is how long a transaction can go unused before it's abandoned
+var txnTimeout = 30 * time.Second
+
+// maxTxns caps how many transactions can be open at once,
+// since every one of them holds a snapshot of the db
+const maxTxns = 1000
+
+// SetTxnTimeout sets how long a transaction can go without a request before
+// it expires. It applies to transactions opened afterwards.
+func SetTxnTimeout(d time.Duration) {
+	txnTimeout = d
+}
+
+// txn is an optimistic transaction. reads come from a snapshot (or the
+// transaction's own writes), writes are buffered, and at commit it fails if
+// anything it read from the snapshot has been written since.
+type txn struct {
+	sync.Mutex
+	id string
+
+	// who opened it, and so who can use it
+	owner string
+
+	snap *levigo.Snapshot
+	ro   *levigo.ReadOptions
+
+	// keys read from the snapshot, which must be unchanged at commit
+	read map[string]bool
+
+	// buffered writes (nil for deletes), and the keys in the order written
+	writes map[string]*txnWrite
+	order  []string
+
+	expires time.Time
+	timer   *time.Timer
+	done    bool
+}
+
+// txnWrite is a value written in a transaction, stored at commit
+type txnWrite struct {
+	h     *valueHeader
+	value []byte
+}
+
+var txns = struct {
+	sync.Mutex
+	open map[string]*txn
+}{open: make(map[string]*txn)}
+
+// beginTxn opens a transaction for owner, or returns nil if too many are open
+func beginTxn(owner string) *txn {
+	txns.Lock()
+	defer txns.Unlock()
+	if len(txns.open) >= maxTxns {
+		return nil
+	}
+
+	t := &txn{
+		id:     randomID(),
+		owner:  owner,
+		snap:   db.NewSnapshot(),
+		ro:     levigo.NewReadOptions(),
+		read:   make(map[string]bool),
+		writes: make(map[string]*txnWrite),
+	}
+	t.ro.SetSnapshot(t.snap)
+	t.expires = time.Now().Add(txnTimeout)
+	t.timer = time.AfterFunc(txnTimeout, t.expire)
+	txns.open[t.id] = t
+	return t
+}
+
+// findTxn looks up an open transaction of owner's and locks it,
+// or returns nil if there isn't one by that id
+func findTxn(id, owner string) *txn {
+	txns.Lock()
+	t := txns.open[id]
+	txns.Unlock()
+	if t == nil || t.owner != owner {
+		return nil
+	}
+
+	t.Lock()
+	if t.done {
+		t.Unlock()
+		return nil
+	}
+	t.expires = time.Now().Add(txnTimeout)
+	t.timer.Reset(txnTimeout)
+	return t
+}
+
+// get reads a key as the transaction sees it
+func (t *txn) get(key []byte) (*valueHeader, []byte, error) {
+	if tw, ok := t.writes[string(key)]; ok {
+		if tw == nil {
+			return nil, nil, nil
+		}
+		h := *tw.h
+		return &h, tw.value, nil
+	}
+
+	t.read[string(key)] = true
+	stored, err := db.Get(t.ro, key)
+	if err != nil || stored == nil {
+		return nil, nil, err
+	}
+	return loadValue(t.ro, stored)
+}
+
+// put buffers a write (a delete for a nil h)
+func (t *txn) put(key []byte, h *valueHeader, value []byte) {
+	if _, ok := t.writes[string(key)]; !ok {
+		t.order = append(t.order, string(key))
+	}
+	if h == nil {
+		t.writes[string(key)] = nil
+	} else {
+		t.writes[string(key)] = &txnWrite{h, value}
+	}
+}
+
+// commit checks the transaction's reads and applies its writes atomically.
+// it returns a 409ing *apiError if something it read has since changed.
+func (t *txn) commit() error {
+	read := make([]string, 0, len(t.read))
+	for key := range t.read {
+		read = append(read, key)
+	}
+	sort.Strings(read)
+
+	return writeOne(func(w *writer) error {
+		for _, key := range read {
+			then, err := db.Get(t.ro, []byte(key))
+			if err != nil {
+				return err
+			}
+			now, err := w.current([]byte(key))
+			if err != nil {
+				return err
+			}
+			same, err := t.unchanged(then, now)
+			if err != nil {
+				return err
+			}
+			if !same {
+				return &apiError{
+					Code:    codeTxnConflict,
+					Message: fmt.Sprintf("%q has changed since the transaction began", key),
+					status:  http.StatusConflict,
+				}
+			}
+		}
+
+		for _, key := range t.order {
+			tw := t.writes[key]
+			if tw == nil {
+				if err := w.del([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			h := *tw.h
+			if err := w.putValue([]byte(key), &h, tw.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unchanged reports whether a key's stored value now (then being what it was
+// in the snapshot) is the same value with the same content type and metadata.
+// anything else about how it's stored, like when it was written or where its
+// chunks are, doesn't matter.
+func (t *txn) unchanged(then, now []byte) (bool, error) {
+	if bytes.Equal(then, now) {
+		return true, nil
+	}
+	if then == nil || now == nil {
+		return false, nil
+	}
+
+	th, tv, err := loadValue(t.ro, then)
+	if err != nil {
+		return false, err
+	}
+	nh, nv, err := loadValue(ro, now)
+	if err != nil {
+		return false, err
+	}
+	th.Modified, nh.Modified = 0, 0
+	return bytes.Equal(tv, nv) && reflect.DeepEqual(th, nh), nil
+}
+
+// end finishes the transaction, releasing its snapshot.
+// it must be called with the transaction locked.
+func (t *txn) end() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.timer.Stop()
+	t.ro.Close()
+	db.ReleaseSnapshot(t.snap)
+
+	txns.Lock()
+	delete(txns.open, t.id)
+	txns.Unlock()
+}
+
+// expire ends the transaction if it's gone unused for txnTimeout
+func (t *txn) expire() {
+	// hold off the db being closed or swapped while releasing the snapshot
+	gate.mu.RLock()
+	defer gate.mu.RUnlock()
+
+	t.Lock()
+	defer t.Unlock()
+	if time.Now().Before(t.expires) {
+		// used since the timer was set
+		return
+	}
+	t.end()
+}
+
+// endTxns ends every open transaction, as when the db is about to be closed
+func endTxns() {
+	txns.Lock()
+	open := make([]*txn, 0, len(txns.open))
+	for _, t := range txns.open {
+		open = append(open, t)
+	}
+	txns.Unlock()
+
+	for _, t := range open {
+		t.Lock()
+		t.end()
+		t.Unlock()
+	}
+}
@@ -0,0 +1,155 @@
+package libldbrest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// valueMagic starts values stored with a header. values without it are
+// stored as-is, as every value was before headers existed, and as values
+// still are when there's nothing to put in a header: no Content-Type,
+// metadata, chunks or compression, and no modification time unless
+// SetTrackModified turned those on.
+const valueMagic = "\x00ldbv\x01"
+
+// trackModified is whether writes record their time, for Last-Modified
+var trackModified bool
+
+// SetTrackModified sets whether values are stored with the time they were
+// written, which GET and HEAD then report as Last-Modified. It's off by
+// default as it gives every value a header, so none are stored as-is.
+func SetTrackModified(on bool) {
+	trackModified = on
+}
+
+// valueHeader is what's stored alongside a value
+type valueHeader struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+
+	// when the value was last written, in unix nanoseconds
+	Modified int64 `json:"modified,omitempty"`
+
+	// where the value is, if it's stored in chunks
+	Chunks *chunkInfo `json:"chunks,omitempty"`
+
+	// how the value is compressed, if it is
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (h *valueHeader) empty() bool {
+	return h.ContentType == "" && len(h.Meta) == 0 && h.Modified == 0 && h.Chunks == nil && h.Encoding == ""
+}
+
+// touch records the value as written now, if modification times
+// are being tracked (and otherwise clears any earlier time)
+func (h *valueHeader) touch() *valueHeader {
+	h.Modified = 0
+	if trackModified {
+		h.Modified = time.Now().UnixNano()
+	}
+	return h
+}
+
+// modTime is when the value was last written, or the zero
+// time for values stored without a header
+func (h *valueHeader) modTime() time.Time {
+	if h.Modified == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, h.Modified)
+}
+
+// encodeValue produces the stored form of a value: the magic, the
+// uvarint length of the JSON header, the header and then the value
+// (or just the value, if there's no header and it can't be mistaken
+// for having one)
+func encodeValue(h *valueHeader, value []byte) []byte {
+	if h == nil {
+		h = &valueHeader{}
+	}
+	if h.empty() && !bytes.HasPrefix(value, []byte(valueMagic)) {
+		return value
+	}
+
+	hdr, _ := json.Marshal(h)
+	stored := make([]byte, 0, len(valueMagic)+binary.MaxVarintLen64+len(hdr)+len(value))
+	stored = append(stored, valueMagic...)
+	stored = append(stored, make([]byte, binary.MaxVarintLen64)...)
+	n := binary.PutUvarint(stored[len(valueMagic):], uint64(len(hdr)))
+	stored = stored[:len(valueMagic)+n]
+	stored = append(stored, hdr...)
+	return append(stored, value...)
+}
+
+// decodeValue splits a stored value into its header and the value itself.
+// values without a (well-formed) header come back as-is with an empty one.
+func decodeValue(stored []byte) (*valueHeader, []byte) {
+	h := &valueHeader{}
+	if !bytes.HasPrefix(stored, []byte(valueMagic)) {
+		return h, stored
+	}
+
+	rest := stored[len(valueMagic):]
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < size {
+		return h, stored
+	}
+	if err := json.Unmarshal(rest[n:n+int(size)], h); err != nil {
+		return &valueHeader{}, stored
+	}
+	return h, rest[n+int(size):]
+}
+
+// valueETag is an entity tag for a stored value
+func valueETag(stored []byte) string {
+	sum := sha256.Sum256(stored)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// valueBody is the value as it was written (without its header, and
+// decompressed), or nil if it can't be decompressed
+func valueBody(stored []byte) []byte {
+	h, value := decodeValue(stored)
+	value, err := decompress(h, value)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// metaPrefix starts the headers carrying user metadata
+const metaPrefix = "X-Ldb-Meta-"
+
+// requestHeader collects what a PUT says to store alongside its value
+func requestHeader(r *http.Request) *valueHeader {
+	h := (&valueHeader{ContentType: r.Header.Get("Content-Type")}).touch()
+	for name, values := range r.Header {
+		if len(name) > len(metaPrefix) && strings.EqualFold(name[:len(metaPrefix)], metaPrefix) {
+			if h.Meta == nil {
+				h.Meta = make(map[string]string)
+			}
+			h.Meta[strings.ToLower(name[len(metaPrefix):])] = strings.Join(values, ", ")
+		}
+	}
+	return h
+}
+
+// writeHeader sets the response headers for a stored value's header
+// (except Last-Modified, which http.ServeContent sets from modTime)
+func (h *valueHeader) writeHeader(w http.ResponseWriter) {
+	if h.ContentType != "" {
+		w.Header().Set("Content-Type", h.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	for name, value := range h.Meta {
+		w.Header().Set(metaPrefix+name, value)
+	}
+}
@@ -0,0 +1,107 @@
+package libldbrest
+
+import (
+	"sync"
+
+	"github.com/jmhodges/levigo"
+)
+
+// writeMu serializes writes made through a writer, so that the read of a
+// key's old value and the write replacing it can't interleave with another
+var writeMu sync.Mutex
+
+// writer collects client writes into one atomic WriteBatch, adding whatever
+// bookkeeping (like secondary index entries) goes along with them
+type writer struct {
+	wb *levigo.WriteBatch
+
+	// values already written to keys in this batch (nil for deleted), which
+	// later ops on the same keys see in place of what's in the db
+	pending map[string][]byte
+}
+
+// newWriter starts a write. it must be finished with close.
+func newWriter() *writer {
+	writeMu.Lock()
+	return &writer{
+		wb:      levigo.NewWriteBatch(),
+		pending: make(map[string][]byte),
+	}
+}
+
+// current reads a key's value as of the writes so far
+func (w *writer) current(key []byte) ([]byte, error) {
+	if value, ok := w.pending[string(key)]; ok {
+		return value, nil
+	}
+	return db.Get(ro, key)
+}
+
+func (w *writer) put(key, value []byte) error {
+	return w.replace(key, value)
+}
+
+// putValue stores a value and its header the way a PUT does, recording it
+// as written now: compressed if its key calls for that, or if it's too big
+// to store whole in chunks written in the same batch
+func (w *writer) putValue(key []byte, h *valueHeader, value []byte) error {
+	h.touch()
+	if len(value) <= valueChunkSize {
+		return w.put(key, encodeValue(h, compressValue(key, h, value)))
+	}
+
+	up := chunkValue(value)
+	up.finish(w.wb)
+	h.Chunks = up.info
+	return w.put(key, encodeValue(h, nil))
+}
+
+func (w *writer) del(key []byte) error {
+	return w.replace(key, nil)
+}
+
+// replace sets key's value (deleting it for nil), along with the bookkeeping
+// for the value it replaces
+func (w *writer) replace(key, value []byte) error {
+	if def, _, ok := splitBucketKey(key); ok && def == nil {
+		return errNoBucket
+	}
+
+	old, err := w.current(key)
+	if err != nil {
+		return err
+	}
+	w.updateIndexes(key, old, value)
+	if h, _ := decodeValue(old); h.Chunks != nil {
+		dropChunks(w.wb, h.Chunks)
+	}
+
+	if value == nil {
+		w.wb.Delete(key)
+	} else {
+		w.wb.Put(key, value)
+	}
+	w.pending[string(key)] = value
+	return nil
+}
+
+// commit writes the batch to the db
+func (w *writer) commit() error {
+	return db.Write(wo, w.wb)
+}
+
+func (w *writer) close() {
+	w.wb.Close()
+	writeMu.Unlock()
+}
+
+// writeOne makes a write with a writer of its own
+func writeOne(f func(*writer) error) error {
+	w := newWriter()
+	defer w.close()
+
+	if err := f(w); err != nil {
+		return err
+	}
+	return w.commit()
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	lib "github.com/teepark/ldbrest/libldbrest"
 )
@@ -24,9 +33,92 @@ func (al *addrlist) Set(addr string) error {
 	return nil
 }
 
+// rateflag to parse "<rate>[:<burst>]" flags into RateLimits
+type rateflag struct{ *lib.RateLimit }
+
+func (rf rateflag) String() string {
+	if rf.RateLimit == nil || rf.Rate == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%g:%d", rf.Rate, rf.Burst)
+}
+
+func (rf rateflag) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return err
+	}
+
+	// without a burst, allow a second's worth at once
+	burst := int(math.Ceil(rate))
+	if len(parts) == 2 {
+		if burst, err = strconv.Atoi(parts[1]); err != nil {
+			return err
+		}
+	}
+
+	*rf.RateLimit = lib.RateLimit{Rate: rate, Burst: burst}
+	return nil
+}
+
+// compressflag to parse repeated "<encoding>:<prefix>" flags into CompressRules
+type compressflag []lib.CompressRule
+
+func (cf *compressflag) String() string {
+	parts := make([]string, len(*cf))
+	for i, rule := range *cf {
+		parts[i] = rule.Encoding + ":" + rule.Prefix
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (cf *compressflag) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%q isn't <encoding>:<prefix>", s)
+	}
+	*cf = append(*cf, lib.CompressRule{Prefix: parts[1], Encoding: parts[0]})
+	return nil
+}
+
 // serveAddrs is the addrlist that captures -s and -serveaddr flags
 var serveAddrs addrlist
 
+// tokenFile is the -tokens flag, a file of API tokens to require
+var tokenFile string
+
+// aclFile is the -acl flag, a file of prefix-scoped access rules
+var aclFile string
+
+// limits collects the -max-* flags
+var limits = lib.DefaultLimits
+
+// rate limits from the -rate-* flags, and -max-expensive
+var (
+	readRate, writeRate, scanRate lib.RateLimit
+	maxExpensive                  int
+)
+
+// compressRules collects the -compress flags
+var compressRules compressflag
+
+// addrFile is the -addr-file flag, where to write the bound addresses
+var addrFile string
+
+// txnTimeout is the -txn-timeout flag, how long a transaction can go unused
+var txnTimeout time.Duration
+
+// comparatorName is the -comparator flag, the key order to open the db with
+var comparatorName string
+
+// lastModified is the -last-modified flag, whether to record write times
+var lastModified bool
+
+// shutdownTimeout is the -shutdown-timeout flag, how long to let in-flight
+// requests finish after a SIGINT or SIGTERM before cutting them off
+var shutdownTimeout time.Duration
+
 func main() {
 	parseFlags()
 
@@ -35,6 +127,33 @@ func main() {
 	}
 	path := flag.Args()[0]
 
+	if tokenFile != "" {
+		if err := lib.LoadTokens(tokenFile); err != nil {
+			log.Fatalf("loading tokens: %s", err)
+		}
+	}
+
+	if aclFile != "" {
+		if err := lib.LoadACL(aclFile); err != nil {
+			log.Fatalf("loading acl: %s", err)
+		}
+	}
+
+	if err := lib.SetCompression(compressRules); err != nil {
+		log.Fatalf("-compress: %s", err)
+	}
+
+	if err := lib.SetComparator(comparatorName); err != nil {
+		log.Fatalf("-comparator: %s", err)
+	}
+
+	lib.SetLimits(limits)
+	lib.SetRateLimits(readRate, writeRate, scanRate)
+	lib.SetMaxExpensive(maxExpensive)
+	lib.SetTxnTimeout(txnTimeout)
+	lib.SetTrackModified(lastModified)
+	setupAccessLog()
+
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
@@ -42,27 +161,17 @@ func main() {
 		lib.OpenDB(path)
 		wg.Done()
 	}()
-	defer lib.CleanupDB()
-
-	router := lib.InitRouter("")
-	run(unavailUntilReady(router, wg))
-}
 
-func unavailUntilReady(h http.Handler, wg *sync.WaitGroup) http.Handler {
-	type maybeHandles struct{ http.Handler }
+	// until OpenDB finishes the endpoints all 503
+	// (except /healthz and /readyz, which say as much)
+	run(lib.InitRouter(""))
 
-	notReady := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain")
-		http.Error(w, "not finished initing DB", http.StatusServiceUnavailable)
-	})
-
-	mh := &maybeHandles{notReady}
-	go func() {
-		wg.Wait()
-		mh.Handler = h
-	}()
-
-	return mh
+	// don't close the db out from under an OpenDB that's still going,
+	// or any requests that the shutdown timeout cut off
+	wg.Wait()
+	lib.StopServing()
+	lib.CleanupDB()
+	log.Print("closed db, exiting")
 }
 
 func parseFlags() {
@@ -77,31 +186,206 @@ func parseFlags() {
 		"serveaddr",
 		"[host]:port or /path/to/socket of where to run the server. may be provided more than once",
 	)
+	flag.StringVar(
+		&tokenFile,
+		"tokens",
+		"",
+		"/path/to/tokenfile of \"<token> <role>\" lines. if provided, requests must carry one as a bearer token",
+	)
+	flag.StringVar(
+		&aclFile,
+		"acl",
+		"",
+		"/path/to/aclfile of \"<identity> <ops> [<prefix>]\" lines. if provided, keys are only accessible as it allows",
+	)
+	flag.StringVar(&tlsCert, "tls-cert", "", "/path/to/cert.pem to serve TLS on [host]:port addresses (reloaded on SIGHUP)")
+	flag.StringVar(&tlsKey, "tls-key", "", "/path/to/key.pem for -tls-cert")
+	flag.StringVar(
+		&tlsClientCA,
+		"tls-client-ca",
+		"",
+		"/path/to/ca.pem. if provided, TLS clients must present a certificate it signed",
+	)
+	flag.StringVar(
+		&addrFile,
+		"addr-file",
+		"",
+		"/path/to/file to write the bound addresses to, one per line (useful with port 0)",
+	)
+	flag.Var(
+		&compressRules,
+		"compress",
+		"<encoding>:<prefix> to store values of keys under prefix compressed, encoding \"gzip\" or \"none\". may be provided more than once",
+	)
+	flag.Int64Var(&limits.MaxBodySize, "max-body-size", limits.MaxBodySize, "maximum bytes in a request body (0 for no limit)")
+	flag.IntVar(&limits.MaxValueSize, "max-value-size", limits.MaxValueSize, "maximum bytes in a value (0 for no limit)")
+	flag.IntVar(&limits.MaxKeyLength, "max-key-length", limits.MaxKeyLength, "maximum bytes in a key (0 for no limit)")
+	flag.IntVar(&limits.MaxKeys, "max-keys", limits.MaxKeys, "maximum keys in a POST /keys (0 for no limit)")
+	flag.IntVar(&limits.MaxBatchOps, "max-batch-ops", limits.MaxBatchOps, "maximum ops in a POST /batch (0 for no limit)")
+	flag.Var(rateflag{&readRate}, "rate-read", "per-client limit on reads, as <per second>[:<burst>]")
+	flag.Var(rateflag{&writeRate}, "rate-write", "per-client limit on writes, as <per second>[:<burst>]")
+	flag.Var(rateflag{&scanRate}, "rate-scan", "per-client limit on iterations, as <per second>[:<burst>]")
+	flag.IntVar(&maxExpensive, "max-expensive", 0, "maximum iterations and snapshots running at once (0 for no limit)")
+	flag.StringVar(&accessLogPath, "access-log", "", "/path/to/file to write access logs to (reopened on SIGHUP), or - for stdout")
+	flag.StringVar(&accessLogFormat, "access-log-format", "json", "access log format, \"json\" or \"combined\"")
+	flag.Float64Var(&accessLogSample, "access-log-sample", 1, "fraction of requests to write to the access log")
+	flag.DurationVar(
+		&accessLogSlow,
+		"access-log-slow",
+		0,
+		"requests taking at least this long are always written to the access log, regardless of sampling",
+	)
+	flag.DurationVar(&txnTimeout, "txn-timeout", 30*time.Second, "how long a transaction can go unused before it expires")
+	flag.BoolVar(&lastModified, "last-modified", false, "store when values are written, for Last-Modified (gives every value a header)")
+	flag.StringVar(
+		&comparatorName,
+		"comparator",
+		"bytewise",
+		"key order: bytewise, reverse-bytewise, numeric-aware or case-insensitive (fixed when the db is created)",
+	)
+	flag.DurationVar(
+		&shutdownTimeout,
+		"shutdown-timeout",
+		30*time.Second,
+		"how long to wait for in-flight requests to finish when shutting down",
+	)
 
 	flag.Parse()
 }
 
+// run serves the router on every serveaddr until a SIGINT or SIGTERM, then
+// shuts the servers down gracefully
 func run(router http.Handler) {
 	if len(serveAddrs) == 0 {
 		serveAddrs = addrlist{"127.0.0.1:7000"}
 	}
 
+	tlsConfig := serverTLSConfig()
+
+	// bind everything up front so a bad address stops us before we serve
+	listeners, err := listen(serveAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bound := make([]string, len(listeners))
+	for i, l := range listeners {
+		bound[i] = l.Addr().String()
+		log.Printf("listening on %s", bound[i])
+	}
+	if addrFile != "" {
+		if err := writeAddrFile(addrFile, bound); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// requests' contexts descend from this, cancelling it aborts long
+	// iterations and snapshots that outlive the shutdown timeout
+	base, abort := context.WithCancel(context.Background())
+	defer abort()
+	baseContext := func(net.Listener) context.Context { return base }
+
+	var (
+		servers []*http.Server
+		sockets []string
+	)
+
 	// start up each server in a goroutine of its own
-	for _, addr := range serveAddrs {
+	for _, l := range listeners {
+		srv := &http.Server{Handler: router, BaseContext: baseContext}
+		servers = append(servers, srv)
+
+		useTLS := false
+		if l.Addr().Network() == "unix" {
+			// unix sockets are always plaintext
+			srv.ConnContext = lib.ConnContext
+			sockets = append(sockets, l.Addr().String())
+		} else if tlsConfig != nil {
+			srv.TLSConfig = tlsConfig
+			useTLS = true
+		}
+
+		go func(srv *http.Server, l net.Listener, useTLS bool) {
+			var err error
+			if useTLS {
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				log.Printf("serving on %s: %s", l.Addr(), err)
+			}
+		}(srv, l, useTLS)
+	}
+
+	// block the main goroutine until we're told to stop
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("shutting down on %s", <-sigs)
+	signal.Stop(sigs)
+
+	shutdown(servers, abort)
+
+	for _, path := range sockets {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+	if addrFile != "" {
+		os.Remove(addrFile)
+	}
+}
+
+// listen binds all the addrs, "[host]:port"s over TCP and anything else as a
+// unix socket path. if any of them fails the ones already bound are closed.
+func listen(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		network := "unix"
 		if strings.Contains(addr, ":") {
-			go http.ListenAndServe(addr, router)
-		} else {
-			go func(addr string) {
-				l, err := net.Listen("unix", addr)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				(&http.Server{Handler: router}).Serve(l)
-			}(addr)
+			network = "tcp"
+		}
+
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
 		}
+		listeners = append(listeners, l)
 	}
+	return listeners, nil
+}
 
-	// prevent the main goroutine from ending (and thus the whole process)
-	<-make(chan struct{})
+// writeAddrFile records the bound addresses one per line. it writes to a
+// temporary file first so anyone polling for path never sees half of it.
+func writeAddrFile(path string, addrs []string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(addrs, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// shutdown stops the servers accepting connections and waits (up to the
+// shutdown timeout) for in-flight requests to finish. requests still going
+// after that are aborted.
+func shutdown(servers []*http.Server, abort func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("timed out waiting for requests to finish, aborting them")
+				abort()
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// paths from the -tls-cert, -tls-key and -tls-client-ca flags
+var tlsCert, tlsKey, tlsClientCA string
+
+// tlsState holds the current *tls.Config, swapped out on reloads
+var tlsState atomic.Value
+
+// loadTLS reads the certificate, key and client CA files into a new
+// *tls.Config and makes it the current one
+func loadTLS() error {
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+
+		// handshakes get this config in place of the server's own, so it
+		// has to offer HTTP/2 itself
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(tlsClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + tlsClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	tlsState.Store(cfg)
+	return nil
+}
+
+// serverTLSConfig produces the *tls.Config for TCP listeners, or nil if TLS
+// wasn't requested. every handshake uses whatever config was loaded last, so
+// a SIGHUP picks up renewed certificates without restarting the servers.
+func serverTLSConfig() *tls.Config {
+	if err := checkTLSFlags(); err != nil {
+		log.Fatal(err)
+	}
+	if tlsCert == "" {
+		return nil
+	}
+
+	if err := loadTLS(); err != nil {
+		log.Fatalf("loading tls: %s", err)
+	}
+	go reloadTLSOnHUP()
+
+	return currentTLSConfig()
+}
+
+// checkTLSFlags rejects combinations of the tls flags that leave out part of
+// what was asked for, rather than quietly serving without it
+func checkTLSFlags() error {
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("-tls-cert and -tls-key must be provided together")
+	}
+	if tlsClientCA != "" && tlsCert == "" {
+		return errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	return nil
+}
+
+// currentTLSConfig hands each handshake the config loaded last
+func currentTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tlsState.Load().(*tls.Config), nil
+		},
+	}
+}
+
+func reloadTLSOnHUP() {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	for range hups {
+		if err := loadTLS(); err != nil {
+			log.Printf("reloading tls (keeping the old certificates): %s", err)
+		} else {
+			log.Print("reloaded tls certificates")
+		}
+	}
+}
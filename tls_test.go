@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldbrest_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tlsCert, tlsKey = writeTestCert(t, dir)
+	defer func() { tlsCert, tlsKey = "", "" }()
+
+	if err := loadTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+		TLSConfig: currentTLSConfig(),
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" {
+		t.Fatalf("TLS handshake didn't negotiate HTTP/2: %s", resp.Proto)
+	}
+}
+
+func TestTLSFlags(t *testing.T) {
+	defer func() { tlsCert, tlsKey, tlsClientCA = "", "", "" }()
+	for _, tc := range []struct {
+		cert, key, clientCA string
+		ok                  bool
+	}{
+		{"", "", "", true},
+		{"cert.pem", "key.pem", "", true},
+		{"cert.pem", "key.pem", "ca.pem", true},
+		{"cert.pem", "", "", false},
+		{"", "key.pem", "", false},
+		{"", "", "ca.pem", false},
+		{"cert.pem", "", "ca.pem", false},
+	} {
+		tlsCert, tlsKey, tlsClientCA = tc.cert, tc.key, tc.clientCA
+		if err := checkTLSFlags(); (err == nil) != tc.ok {
+			t.Errorf("cert %q, key %q, client CA %q: %v", tc.cert, tc.key, tc.clientCA, err)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key into dir
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}